@@ -0,0 +1,155 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// ScanArchive indexes the .lua files of a zip, tar or tar.gz archive by module name,
+// "foo/bar.lua" and "foo/bar/init.lua" both providing module "foo.bar".
+// The archive format is deduced from the name suffix.
+func ScanArchive(name string, r io.Reader) (map[string]LuaFile, error) {
+	files, err := readArchive(name, r)
+	if err != nil {
+		return nil, err
+	}
+	libs := make(map[string]LuaFile)
+	for p, content := range files {
+		if !strings.HasSuffix(p, ".lua") {
+			continue
+		}
+		module := strings.TrimSuffix(p, ".lua")
+		if module == "init" {
+			continue
+		}
+		module = strings.TrimSuffix(module, "/init")
+		module = strings.Replace(module, "/", ".", -1)
+		if _, ok := libs[module]; ok && strings.HasSuffix(p, "/init.lua") {
+			// foo.lua takes precedence over foo/init.lua, as with the default package.path
+			continue
+		}
+		libs[module] = LuaFile{
+			Name: path.Base(name) + ":" + p,
+			Code: string(content),
+		}
+	}
+	return libs, nil
+}
+
+// ScanArchiveFile reads a Lua module archive from disk
+func ScanArchiveFile(file string) (map[string]LuaFile, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ScanArchive(file, f)
+}
+
+// ScanArchiveFs reads a Lua module archive from a sandbox filesystem
+func ScanArchiveFs(fs Filesystem, file string) (map[string]LuaFile, error) {
+	f, err := fs.GetReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ScanArchive(file, f)
+}
+
+func readArchive(name string, r io.Reader) (map[string][]byte, error) {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return readZip(r)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return readTar(gz)
+	case strings.HasSuffix(lower, ".tar"):
+		return readTar(r)
+	default:
+		return nil, fmt.Errorf("unsupported archive format: %s", name)
+	}
+}
+
+func readZip(r io.Reader) (map[string][]byte, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", f.Name, err)
+		}
+		files[cleanArchivePath(f.Name)] = content
+	}
+	return files, nil
+}
+
+func readTar(r io.Reader) (map[string][]byte, error) {
+	tr := tar.NewReader(r)
+	files := make(map[string][]byte)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !h.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", h.Name, err)
+		}
+		files[cleanArchivePath(h.Name)] = content
+	}
+}
+
+func cleanArchivePath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
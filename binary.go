@@ -0,0 +1,294 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Shopify/go-lua"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack"
+	"io"
+	"sort"
+)
+
+// binaryPullOptions keep the number and boolean keys of tables, which MessagePack and CBOR maps support,
+// and encode strings that are not valid UTF-8 as byte strings
+func binaryPullOptions(l *lua.State) PullOptions {
+	opts := environmentPullOptions(l)
+	opts.Keys = KeysInterface
+	opts.Bytes = true
+	return opts
+}
+
+// EncodeMsgpack encodes a value pulled from Lua, integral numbers as the smallest integers and map keys sorted
+func EncodeMsgpack(v interface{}) ([]byte, error) {
+	b := &bytes.Buffer{}
+	err := msgpack.NewEncoder(b).SortMapKeys(true).UseCompactEncoding(true).Encode(msgpackSorted(v))
+	return b.Bytes(), err
+}
+
+// msgpackMap encodes its keys sorted, numbers first then booleans and strings, for a deterministic output
+type msgpackMap map[interface{}]interface{}
+
+func (m msgpackMap) EncodeMsgpack(e *msgpack.Encoder) error {
+	keys := make([]interface{}, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ri, rj := keyRank(keys[i]), keyRank(keys[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	if err := e.EncodeMapLen(len(m)); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := e.Encode(k); err != nil {
+			return err
+		}
+		if err := e.Encode(m[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func keyRank(k interface{}) int {
+	switch k.(type) {
+	case int, int64, float64:
+		return 0
+	case bool:
+		return 1
+	case string:
+		return 2
+	}
+	return 3
+}
+
+func msgpackSorted(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(msgpackMap, len(v))
+		for k, e := range v {
+			m[k] = msgpackSorted(e)
+		}
+		return m
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = msgpackSorted(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = msgpackSorted(e)
+		}
+	}
+	return v
+}
+
+// DecodeMsgpack decodes a MessagePack value, integers as int64 or uint64 and maps as map[interface{}]interface{}
+func DecodeMsgpack(data []byte) (interface{}, error) {
+	if err := checkMsgpackLengths(data); err != nil {
+		return nil, err
+	}
+	var v interface{}
+	decoder := msgpack.NewDecoder(bytes.NewReader(data)).UseDecodeInterfaceLoose(true)
+	decoder.SetDecodeMapFunc(decodeMsgpackMap)
+	err := decoder.Decode(&v)
+	return v, err
+}
+
+// checkMsgpackLengths walks the headers of a MessagePack value and checks every length against the bytes left,
+// so that the decoder never allocates for values the input cannot hold
+func checkMsgpackLengths(data []byte) error {
+	pos := 0
+	length := func(size int) (int, error) {
+		if len(data)-pos < size {
+			return 0, io.ErrUnexpectedEOF
+		}
+		n := 0
+		for _, b := range data[pos : pos+size] {
+			n = n<<8 | int(b)
+		}
+		pos += size
+		return n, nil
+	}
+	for pending := 1; pending > 0; pending-- {
+		if pos >= len(data) {
+			return io.ErrUnexpectedEOF
+		}
+		c := data[pos]
+		pos++
+		var skip, items int
+		var err error
+		switch {
+		case c <= 0x7f || c >= 0xe0 || c == 0xc0 || c == 0xc2 || c == 0xc3:
+		case c <= 0x8f:
+			items = 2 * int(c&0x0f)
+		case c <= 0x9f:
+			items = int(c & 0x0f)
+		case c <= 0xbf:
+			skip = int(c & 0x1f)
+		case c == 0xc4 || c == 0xd9:
+			skip, err = length(1)
+		case c == 0xc5 || c == 0xda:
+			skip, err = length(2)
+		case c == 0xc6 || c == 0xdb:
+			skip, err = length(4)
+		case c >= 0xc7 && c <= 0xc9:
+			skip, err = length(1 << (c - 0xc7))
+			skip++
+		case c == 0xca || c == 0xce || c == 0xd2:
+			skip = 4
+		case c == 0xcb || c == 0xcf || c == 0xd3:
+			skip = 8
+		case c == 0xcc || c == 0xd0:
+			skip = 1
+		case c == 0xcd || c == 0xd1:
+			skip = 2
+		case c >= 0xd4 && c <= 0xd8:
+			skip = 1 + 1<<(c-0xd4)
+		case c == 0xdc:
+			items, err = length(2)
+		case c == 0xdd:
+			items, err = length(4)
+		case c == 0xde:
+			items, err = length(2)
+			items *= 2
+		case c == 0xdf:
+			items, err = length(4)
+			items *= 2
+		default:
+			return fmt.Errorf("msgpack: invalid code %x", c)
+		}
+		if err != nil {
+			return err
+		}
+		// every pending value uses at least one byte
+		if skip > len(data)-pos || items > len(data)-pos-skip-(pending-1) {
+			return fmt.Errorf("msgpack: length at offset %d exceeds the input", pos)
+		}
+		pos += skip
+		pending += items
+	}
+	return nil
+}
+
+// msgpackMapAllocLimit bounds the space reserved for a map before its entries are decoded
+const msgpackMapAllocLimit = 1024
+
+// decodeMsgpackMap accepts string, number and boolean keys, unlike the default decoding to map[string]interface{}
+func decodeMsgpackMap(d *msgpack.Decoder) (interface{}, error) {
+	n, err := d.DecodeMapLen()
+	if err != nil || n == -1 {
+		return nil, err
+	}
+	hint := n
+	if hint > msgpackMapAllocLimit {
+		hint = msgpackMapAllocLimit
+	}
+	m := make(map[interface{}]interface{}, hint)
+	for i := 0; i < n; i++ {
+		k, err := d.DecodeInterfaceLoose()
+		if err != nil {
+			return nil, err
+		}
+		switch key := k.(type) {
+		case []byte:
+			k = string(key)
+		case string, bool, int64, uint64, float32, float64:
+		default:
+			return nil, fmt.Errorf("msgpack: invalid map key type %T", k)
+		}
+		v, err := d.DecodeInterfaceLoose()
+		if err != nil {
+			return nil, err
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+// EncodeCBOR encodes a value pulled from Lua in canonical CBOR, integral numbers as integers
+func EncodeCBOR(v interface{}) ([]byte, error) {
+	mode, err := cbor.CanonicalEncOptions().EncMode()
+	if err != nil {
+		return nil, err
+	}
+	return mode.Marshal(v)
+}
+
+// DecodeCBOR decodes a CBOR value
+func DecodeCBOR(data []byte) (interface{}, error) {
+	var v interface{}
+	err := cbor.Unmarshal(data, &v)
+	return v, err
+}
+
+func reprBinary(l *lua.State, encode func(interface{}) ([]byte, error)) int {
+	v, err := newPuller(l, binaryPullOptions(l)).value(1, "$")
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	data, err := encode(v)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	l.PushString(string(data))
+	return 1
+}
+
+func parseBinary(l *lua.State, decode func([]byte) (interface{}, error)) int {
+	data, err := PullBytes(l, 1)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	v, err := decode(data)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	DeepPushWith(l, v, decodeOptions(l, 2))
+	return 1
+}
+
+func ReprMsgpack(l *lua.State) int {
+	return reprBinary(l, EncodeMsgpack)
+}
+
+func ParseMsgpack(l *lua.State) int {
+	return parseBinary(l, DecodeMsgpack)
+}
+
+func ReprCbor(l *lua.State) int {
+	return reprBinary(l, EncodeCBOR)
+}
+
+func ParseCbor(l *lua.State) int {
+	return parseBinary(l, DecodeCBOR)
+}
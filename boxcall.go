@@ -34,7 +34,9 @@ var luaBoxSyscalls = []lua.RegistryFunction{
 			return 0
 		}
 		log := env.Log
-		p, err := PullTable(l, 3)
+		opts := env.PullOptions
+		opts.Keys = KeysString
+		p, err := PullTableWith(l, 3, opts)
 		var params map[string]interface{}
 		if err != nil {
 			// No params
@@ -72,14 +74,44 @@ var luaBoxSyscalls = []lua.RegistryFunction{
 		return 0
 	}},
 	{"yamlRepr", Repr},
+	{"yamlReprWith", ReprWith},
 	{"yamlParse", Parse},
+	{"yamlParseAll", ParseAll},
+	{"yamlDocument", ParseDocument},
 	{"jsonRepr", ReprJson},
 	{"jsonParse", ParseJson},
+	{"jsonRecords", JSONRecordsOpen},
+	{"jsonWriter", JSONWriterOpen},
+	{"tomlRepr", ReprToml},
+	{"tomlParse", ParseToml},
+	{"csvRepr", ReprCsv},
+	{"csvParse", ParseCsv},
+	{"csvRows", CSVRowsOpen},
+	{"tsvRepr", ReprTsv},
+	{"tsvParse", ParseTsv},
+	{"iniRepr", ReprIni},
+	{"iniParse", ParseIni},
+	{"msgpackRepr", ReprMsgpack},
+	{"msgpackParse", ParseMsgpack},
+	{"cborRepr", ReprCbor},
+	{"cborParse", ParseCbor},
 	{"getEnv", EnvGetEnv},
 	{"getArgs", EnvGetArgs},
+	{"modules", EnvGetModules},
+	{"array", MarkArray},
+	{"object", MarkObject},
+	{"keys", TableKeys},
+	{"validate", Validate},
+	{"query", RunQuery},
+	{"merge", Merge},
+	{"mergePatch", MergePatch},
+	{"diff", Diff},
+	{"patch", Patch},
 }
 
 func SyscallOpen(l *lua.State) int {
 	lua.NewLibrary(l, luaBoxSyscalls)
+	PushNull(l)
+	l.SetField(-2, "null")
 	return 1
 }
@@ -0,0 +1,355 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"github.com/Shopify/go-lua"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// CSVOptions tunes the CSV and TSV codecs
+type CSVOptions struct {
+	Separator rune
+	// Header tells that the first row names the columns, rows being decoded to tables keyed by column
+	Header bool
+	// Columns selects and orders the encoded columns, all the keys of the rows when empty
+	Columns []string
+	// Comment starts lines to skip when decoding
+	Comment rune
+	// LazyQuotes accepts quotes in unquoted fields when decoding
+	LazyQuotes bool
+	// TrimSpace ignores the leading space of fields when decoding
+	TrimSpace bool
+	// QuoteAll quotes every field when encoding
+	QuoteAll bool
+	// CRLF ends encoded lines with \r\n
+	CRLF bool
+}
+
+// validDelimiter tells whether r can separate fields or start comments, as encoding/csv requires
+func validDelimiter(r rune) bool {
+	return r != 0 && r != '"' && r != '\r' && r != '\n' && utf8.ValidRune(r) && r != utf8.RuneError
+}
+
+// check validates the separator and the comment character
+func (o CSVOptions) check() error {
+	if !validDelimiter(o.Separator) {
+		return fmt.Errorf("invalid separator %q", o.Separator)
+	}
+	if o.Comment != 0 && (!validDelimiter(o.Comment) || o.Comment == o.Separator) {
+		return fmt.Errorf("invalid comment character %q", o.Comment)
+	}
+	return nil
+}
+
+// csvOptions reads the options table of the CSV codecs at idx:
+// separator, header (true by default), columns, comment, lazyQuotes, trimSpace, quoteAll and crlf
+func csvOptions(l *lua.State, idx int, separator rune) CSVOptions {
+	opts := CSVOptions{Separator: separator, Header: true}
+	if !l.IsTable(idx) {
+		return opts
+	}
+	optRune := func(name string, r *rune) {
+		l.Field(idx, name)
+		if s, ok := l.ToString(-1); ok && s != "" {
+			*r = []rune(s)[0]
+		}
+		l.Pop(1)
+	}
+	optRune("separator", &opts.Separator)
+	optRune("comment", &opts.Comment)
+	l.Field(idx, "header")
+	if !l.IsNil(-1) {
+		opts.Header = l.ToBoolean(-1)
+	}
+	l.Pop(1)
+	l.Field(idx, "columns")
+	if l.IsTable(-1) {
+		for i := 1; ; i++ {
+			l.RawGetInt(-1, i)
+			s, ok := l.ToString(-1)
+			l.Pop(1)
+			if !ok {
+				break
+			}
+			opts.Columns = append(opts.Columns, s)
+		}
+	}
+	l.Pop(1)
+	opts.LazyQuotes = optionFlag(l, idx, "lazyQuotes")
+	opts.TrimSpace = optionFlag(l, idx, "trimSpace")
+	opts.QuoteAll = optionFlag(l, idx, "quoteAll")
+	opts.CRLF = optionFlag(l, idx, "crlf")
+	if err := opts.check(); err != nil {
+		lua.ArgumentError(l, idx, err.Error())
+	}
+	return opts
+}
+
+// CSVRows decodes CSV rows one at a time, as OrderedMap keyed by column with a header, as []interface{} otherwise
+type CSVRows struct {
+	r      io.Reader
+	reader *csv.Reader
+	opts   CSVOptions
+	header []string
+	closed bool
+}
+
+// NewCSVRows reads rows from r, closed by Close when it is an io.Closer
+func NewCSVRows(r io.Reader, opts CSVOptions) *CSVRows {
+	reader := csv.NewReader(r)
+	reader.Comma = opts.Separator
+	reader.Comment = opts.Comment
+	reader.LazyQuotes = opts.LazyQuotes
+	reader.TrimLeadingSpace = opts.TrimSpace
+	reader.FieldsPerRecord = -1
+	return &CSVRows{r: r, reader: reader, opts: opts}
+}
+
+// Next returns the next row, or io.EOF at the end of the stream
+func (c *CSVRows) Next() (interface{}, error) {
+	record, err := c.reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.Header && c.header == nil {
+		c.header = record
+		return c.Next()
+	}
+	if c.header == nil {
+		row := make([]interface{}, len(record))
+		for i, field := range record {
+			row[i] = field
+		}
+		return row, nil
+	}
+	row := make(OrderedMap, 0, len(record))
+	for i, field := range record {
+		if i < len(c.header) {
+			row = append(row, MapItem{Key: c.header[i], Value: field})
+		}
+	}
+	return row, nil
+}
+
+// Close closes the underlying reader once, later calls do nothing
+func (c *CSVRows) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if closer, ok := c.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// DecodeCSV decodes all the rows of a CSV document
+func DecodeCSV(s string, opts CSVOptions) ([]interface{}, error) {
+	rows := NewCSVRows(strings.NewReader(s), opts)
+	res := make([]interface{}, 0)
+	for {
+		row, err := rows.Next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, row)
+	}
+}
+
+func csvField(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []byte:
+		return string(v), nil
+	}
+	return "", fmt.Errorf("unsupported %T field", v)
+}
+
+// csvColumns lists the keys of the rows in their order of appearance
+func csvColumns(rows []interface{}) []string {
+	columns := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		items, ok := mapItems(row)
+		if !ok {
+			continue
+		}
+		for _, item := range items {
+			k := fmt.Sprint(item.Key)
+			if !seen[k] {
+				seen[k] = true
+				columns = append(columns, k)
+			}
+		}
+	}
+	return columns
+}
+
+// EncodeCSV encodes rows pulled from Lua, either arrays of fields or tables keyed by column
+func EncodeCSV(rows []interface{}, opts CSVOptions) (string, error) {
+	if err := opts.check(); err != nil {
+		return "", err
+	}
+	columns := opts.Columns
+	if len(columns) == 0 {
+		columns = csvColumns(rows)
+	}
+	records := make([][]string, 0, len(rows)+1)
+	if opts.Header && len(columns) > 0 {
+		records = append(records, columns)
+	}
+	for i, row := range rows {
+		var fields []interface{}
+		if items, ok := mapItems(row); ok {
+			byColumn := make(map[string]interface{}, len(items))
+			for _, item := range items {
+				byColumn[fmt.Sprint(item.Key)] = item.Value
+			}
+			fields = make([]interface{}, len(columns))
+			for j, column := range columns {
+				fields[j] = byColumn[column]
+			}
+		} else if a, ok := row.([]interface{}); ok {
+			fields = a
+		} else {
+			return "", fmt.Errorf("row %d: expected a table, got %T", i+1, row)
+		}
+		record := make([]string, len(fields))
+		for j, field := range fields {
+			s, err := csvField(field)
+			if err != nil {
+				return "", fmt.Errorf("row %d, field %d: %v", i+1, j+1, err)
+			}
+			record[j] = s
+		}
+		records = append(records, record)
+	}
+	b := &bytes.Buffer{}
+	if opts.QuoteAll {
+		writeQuoted(b, records, opts)
+		return b.String(), nil
+	}
+	w := csv.NewWriter(b)
+	w.Comma = opts.Separator
+	w.UseCRLF = opts.CRLF
+	if err := w.WriteAll(records); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func writeQuoted(b *bytes.Buffer, records [][]string, opts CSVOptions) {
+	eol := "\n"
+	if opts.CRLF {
+		eol = "\r\n"
+	}
+	for _, record := range records {
+		for i, field := range record {
+			if i > 0 {
+				b.WriteRune(opts.Separator)
+			}
+			b.WriteString(`"` + strings.Replace(field, `"`, `""`, -1) + `"`)
+		}
+		b.WriteString(eol)
+	}
+}
+
+func parseCSV(l *lua.State, separator rune) int {
+	rows, err := DecodeCSV(lua.CheckString(l, 1), csvOptions(l, 2, separator))
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	DeepPush(l, rows)
+	return 1
+}
+
+func reprCSV(l *lua.State, separator rune) int {
+	rows, err := PullTableWith(l, 1, encoderPullOptions(l))
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	a, ok := rows.([]interface{})
+	// an empty table converts to an empty object
+	if items, _ := mapItems(rows); !ok && len(items) > 0 {
+		l.PushString("rows must be an array")
+		l.Error()
+		return 0
+	}
+	s, err := EncodeCSV(a, csvOptions(l, 2, separator))
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	l.PushString(s)
+	return 1
+}
+
+func ParseCsv(l *lua.State) int {
+	return parseCSV(l, ',')
+}
+
+func ParseTsv(l *lua.State) int {
+	return parseCSV(l, '\t')
+}
+
+func ReprCsv(l *lua.State) int {
+	return reprCSV(l, ',')
+}
+
+func ReprTsv(l *lua.State) int {
+	return reprCSV(l, '\t')
+}
+
+// CSVRowsOpen returns an iterator over the rows of a CSV file of the environment filesystem,
+// or of the environment input when no file is given
+func CSVRowsOpen(l *lua.State) int {
+	opts := csvOptions(l, 2, ',')
+	r, err := openInput(l, 1)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	return pushRecords(l, NewCSVRows(r, opts), PushOptions{})
+}
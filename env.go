@@ -48,6 +48,12 @@ type Environment struct {
 	GoLibs     []lua.RegistryFunction
 	LuaLibs    map[string]LuaFile
 	PreInitLua []LuaFile
+	// AllowBinaryChunks lets load, loadfile, dofile and require accept precompiled chunks from Fs, Input and strings.
+	// go-lua does not verify binary chunks, a corrupted one can exhaust the host memory: only enable it for trusted scripts.
+	// LuaLibs are trusted and may always be precompiled, see CompileLibs
+	AllowBinaryChunks bool
+	// PullOptions applies to the conversions of Lua tables done by the luabox library
+	PullOptions PullOptions
 }
 
 func (e *Environment) Init() (*lua.State, error) {
@@ -81,6 +87,8 @@ func (e *Environment) Init() (*lua.State, error) {
 		return loadHelper(l, LoadFile(l, f, m), e)
 	})
 	l.SetField(-2, "loadfile")
+	l.PushGoFunction(boxLoad)
+	l.SetField(-2, "load")
 	libs := []lua.RegistryFunction{
 		{"package", PackageOpen},
 		{"table", lua.TableOpen},
@@ -125,6 +133,15 @@ func SetEnvironment(l *lua.State, environment *Environment) {
 	l.SetTable(lua.RegistryIndex)
 }
 
+// lookupEnvironment returns the environment of a state, if any
+func lookupEnvironment(l *lua.State) (*Environment, bool) {
+	l.PushString(EnvKey)
+	l.Table(lua.RegistryIndex)
+	env, ok := l.ToUserData(-1).(*Environment)
+	l.Pop(1)
+	return env, ok
+}
+
 func GetEnvironment(l *lua.State) (*Environment, error) {
 	l.PushString(EnvKey)
 	l.Table(lua.RegistryIndex)
@@ -41,6 +41,7 @@ const EReadonly = FsError("readonly filesystem")
 
 type Filesystem interface {
 	GetReader(file string) (io.ReadCloser, error)
+	// GetWriter opens a file for writing, creating it when missing and truncating it otherwise
 	GetWriter(file string) (io.WriteCloser, error)
 	List(path string) ([]FileInfo, error)
 	Delete(path string) error
@@ -0,0 +1,151 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Shopify/go-lua"
+)
+
+const refsKey = "LUABOX_REFS"
+
+// ErrReleased is returned when calling a released LuaFunction
+var ErrReleased = errors.New("lua function released")
+
+// contextCheckCount is the number of instructions between two checks of the call context
+const contextCheckCount = 1000
+
+type refTable struct {
+	next int
+	live map[int]*LuaFunction
+}
+
+// LuaFunction is a handle on a Lua function, kept in the registry until released.
+// Like the state itself, it must only be used from the goroutine owning the state.
+type LuaFunction struct {
+	l    *lua.State
+	refs *refTable
+	ref  int
+}
+
+func getRefTable(l *lua.State) *refTable {
+	l.Field(lua.RegistryIndex, refsKey)
+	refs, ok := l.ToUserData(-1).(*refTable)
+	l.Pop(1)
+	if !ok {
+		refs = &refTable{live: make(map[int]*LuaFunction)}
+		l.PushUserData(refs)
+		l.SetField(lua.RegistryIndex, refsKey)
+	}
+	return refs
+}
+
+func refsTable(l *lua.State) {
+	lua.SubTable(l, lua.RegistryIndex, refsKey+"_VALUES")
+}
+
+// NewLuaFunction references the function at idx
+func NewLuaFunction(l *lua.State, idx int) (*LuaFunction, error) {
+	if !l.IsFunction(idx) {
+		return nil, fmt.Errorf("need a function at index %d, got %s", idx, lua.TypeNameOf(l, idx))
+	}
+	idx = l.AbsIndex(idx)
+	refs := getRefTable(l)
+	refs.next++
+	f := &LuaFunction{l: l, refs: refs, ref: refs.next}
+	refsTable(l)
+	l.PushValue(idx)
+	l.RawSetInt(-2, f.ref)
+	l.Pop(1)
+	refs.live[f.ref] = f
+	return f, nil
+}
+
+// Release drops the reference to the function, further calls returning ErrReleased
+func (f *LuaFunction) Release() {
+	if _, ok := f.refs.live[f.ref]; !ok {
+		return
+	}
+	delete(f.refs.live, f.ref)
+	refsTable(f.l)
+	f.l.PushNil()
+	f.l.RawSetInt(-2, f.ref)
+	f.l.Pop(1)
+}
+
+// ReleaseFunctions releases all the LuaFunction handles of a state, to be called when the state is discarded
+func ReleaseFunctions(l *lua.State) {
+	refs := getRefTable(l)
+	for _, f := range refs.live {
+		f.Release()
+	}
+}
+
+// Push pushes the function on the stack of its state
+func (f *LuaFunction) Push() error {
+	if _, ok := f.refs.live[f.ref]; !ok {
+		return ErrReleased
+	}
+	refsTable(f.l)
+	f.l.RawGetInt(-1, f.ref)
+	f.l.Remove(-2)
+	return nil
+}
+
+// Call calls the function with arguments converted by DeepPush and returns its results converted like PullVarargs.
+// Lua errors are returned as errors, and the call is interrupted once the context is done.
+func (f *LuaFunction) Call(ctx context.Context, args ...interface{}) ([]interface{}, error) {
+	l := f.l
+	top := l.Top()
+	defer l.SetTop(top)
+	// arguments are pushed by the protected call, DeepPush raising Lua errors on cycles and unsupported values
+	l.PushGoFunction(func(l *lua.State) int {
+		for _, arg := range args {
+			DeepPush(l, arg)
+		}
+		l.Call(len(args), lua.MultipleReturns)
+		return l.Top()
+	})
+	if err := f.Push(); err != nil {
+		return nil, err
+	}
+	if ctx != nil && ctx.Done() != nil {
+		hook, mask, count := lua.DebugHook(l), lua.DebugHookMask(l), lua.DebugHookCount(l)
+		lua.SetDebugHook(l, func(l *lua.State, ar lua.Debug) {
+			select {
+			case <-ctx.Done():
+				lua.Errorf(l, "call interrupted: %s", ctx.Err().Error())
+			default:
+			}
+			if hook != nil && (ar.Event != lua.HookCount || mask&lua.MaskCount != 0) {
+				hook(l, ar)
+			}
+		}, mask|lua.MaskCount, contextCheckCount)
+		defer lua.SetDebugHook(l, hook, mask, count)
+	}
+	if err := l.ProtectedCall(1, lua.MultipleReturns, 0); err != nil {
+		msg, ok := l.ToString(-1)
+		if !ok {
+			msg = err.Error()
+		}
+		return nil, errors.New(msg)
+	}
+	return PullVarargs(l, top+1)
+}
@@ -3,8 +3,11 @@ module github.com/pujo-j/luabox
 go 1.13
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/Shopify/go-lua v0.0.0-20191113154418-05ce435a9edd
+	github.com/fxamacker/cbor/v2 v2.2.0
 	github.com/markbates/pkger v0.15.1
+	github.com/vmihailenco/msgpack v4.0.4+incompatible
 	go.uber.org/zap v1.15.0
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
@@ -0,0 +1,205 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/Shopify/go-lua"
+	"strings"
+)
+
+type iniSection struct {
+	name  string
+	items OrderedMap
+}
+
+// DecodeINI decodes an INI document to an OrderedMap of the keys before any section,
+// followed by the sections as OrderedMap. Values are strings, optionally quoted.
+func DecodeINI(s string) (OrderedMap, error) {
+	global := &iniSection{}
+	sections := []*iniSection{global}
+	byName := make(map[string]*iniSection)
+	current := global
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == ';' || text[0] == '#' {
+			continue
+		}
+		if text[0] == '[' {
+			if text[len(text)-1] != ']' {
+				return nil, fmt.Errorf("line %d: unclosed section header", line)
+			}
+			name := strings.TrimSpace(text[1 : len(text)-1])
+			section, ok := byName[name]
+			if !ok {
+				section = &iniSection{name: name}
+				byName[name] = section
+				sections = append(sections, section)
+			}
+			current = section
+			continue
+		}
+		sep := strings.IndexAny(text, "=:")
+		if sep <= 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", line)
+		}
+		key := strings.TrimSpace(text[:sep])
+		current.items = append(current.items, MapItem{Key: key, Value: iniValue(strings.TrimSpace(text[sep+1:]))})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	root := global.items
+	for _, section := range sections[1:] {
+		root = append(root, MapItem{Key: section.name, Value: section.items})
+	}
+	return root, nil
+}
+
+// iniValue removes the inline comment and the quotes of a value.
+// Double quoted values may escape quotes and backslashes with a backslash.
+func iniValue(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') {
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			c := s[i]
+			if c == '\\' && s[0] == '"' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+				i++
+				b.WriteByte(s[i])
+				continue
+			}
+			if c == s[0] {
+				if rest := strings.TrimSpace(s[i+1:]); rest == "" || rest[0] == ';' || rest[0] == '#' {
+					return b.String()
+				}
+				break
+			}
+			b.WriteByte(c)
+		}
+	}
+	for _, marker := range []string{" ;", " #", "\t;", "\t#"} {
+		if i := strings.Index(s, marker); i >= 0 {
+			s = strings.TrimSpace(s[:i])
+		}
+	}
+	return s
+}
+
+// iniName checks a key or section name, which cannot be quoted
+func iniName(kind string, name interface{}) (string, error) {
+	s := fmt.Sprint(name)
+	if s == "" || strings.TrimSpace(s) != s || strings.ContainsAny(s, "=:[];#\r\n") {
+		return "", fmt.Errorf("invalid %s name %q", kind, s)
+	}
+	return s, nil
+}
+
+func iniField(v interface{}) (string, error) {
+	s, err := csvField(v)
+	if err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(s, "\r\n") {
+		return "", fmt.Errorf("value %q contains a line break", s)
+	}
+	if strings.TrimSpace(s) != s || strings.ContainsAny(s, ";#") || strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'") {
+		return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`, nil
+	}
+	return s, nil
+}
+
+// EncodeINI encodes a table pulled from Lua, its table values being sections and the others global keys
+func EncodeINI(v interface{}) (string, error) {
+	items, ok := mapItems(v)
+	if !ok {
+		return "", fmt.Errorf("expected a table, got %T", v)
+	}
+	b := &bytes.Buffer{}
+	sections := make(OrderedMap, 0)
+	for _, item := range items {
+		if _, ok := mapItems(item.Value); ok {
+			sections = append(sections, item)
+			continue
+		}
+		key, err := iniName("key", item.Key)
+		if err != nil {
+			return "", err
+		}
+		s, err := iniField(item.Value)
+		if err != nil {
+			return "", fmt.Errorf("key %s: %v", key, err)
+		}
+		fmt.Fprintf(b, "%s = %s\n", key, s)
+	}
+	for _, section := range sections {
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		name, err := iniName("section", section.Key)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(b, "[%s]\n", name)
+		entries, _ := mapItems(section.Value)
+		for _, entry := range entries {
+			key, err := iniName("key", entry.Key)
+			if err != nil {
+				return "", fmt.Errorf("section %s: %v", name, err)
+			}
+			s, err := iniField(entry.Value)
+			if err != nil {
+				return "", fmt.Errorf("section %s, key %s: %v", name, key, err)
+			}
+			fmt.Fprintf(b, "%s = %s\n", key, s)
+		}
+	}
+	return b.String(), nil
+}
+
+func ParseIni(l *lua.State) int {
+	res, err := DecodeINI(lua.CheckString(l, 1))
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	DeepPush(l, res)
+	return 1
+}
+
+func ReprIni(l *lua.State) int {
+	p, err := PullTableWith(l, 1, encoderPullOptions(l))
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	s, err := EncodeINI(p)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	l.PushString(s)
+	return 1
+}
@@ -19,12 +19,15 @@ package luabox
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/Shopify/go-lua"
 	"io"
 	"strings"
 )
 
+// LoadLuaFile loads a library of LuaLibs, which is trusted and may be a precompiled chunk
 func LoadLuaFile(l *lua.State, f LuaFile) error {
 	var fileName = f.Name
 	fileNameIndex := l.Top() + 1
@@ -44,7 +47,7 @@ func LoadLuaFile(l *lua.State, f LuaFile) error {
 		r = bufio.NewReader(io.MultiReader(strings.NewReader("\n"), r))
 	}
 	s, _ := l.ToString(-1)
-	err := l.Load(r, s, "text")
+	err := l.Load(r, s, "bt")
 	switch err {
 	case nil, lua.SyntaxError, lua.MemoryError: // do nothing
 	default:
@@ -55,14 +58,68 @@ func LoadLuaFile(l *lua.State, f LuaFile) error {
 	return err
 }
 
-func LoadFile(l *lua.State, fileName, mode string) error {
-	if !("text" == mode) {
-		return fmt.Errorf("invalid file mode %s", mode)
+// CompileLuaFile precompiles a library to a binary chunk, to be shipped in LuaLibs
+func CompileLuaFile(f LuaFile) (LuaFile, error) {
+	l := lua.NewState()
+	if err := LoadLuaFile(l, f); err != nil {
+		msg, _ := l.ToString(-1)
+		return LuaFile{}, errors.New(msg)
+	}
+	b := &bytes.Buffer{}
+	if err := l.Dump(b); err != nil {
+		return LuaFile{}, err
+	}
+	return LuaFile{Name: f.Name, Code: b.String()}, nil
+}
+
+func CompileLibs(libs map[string]LuaFile) (map[string]LuaFile, error) {
+	res := make(map[string]LuaFile)
+	for name, f := range libs {
+		c, err := CompileLuaFile(f)
+		if err != nil {
+			return nil, err
+		}
+		res[name] = c
+	}
+	return res, nil
+}
+
+// chunkMode validates a load mode ("b", "t" or "bt"), binary chunks being refused unless the environment allows them.
+// The default mode is "bt" when binary chunks are allowed, "t" otherwise
+func chunkMode(env *Environment, mode string) (string, error) {
+	switch mode {
+	case "":
+		mode = "bt"
+		if !env.AllowBinaryChunks {
+			mode = "t"
+		}
+	case "b", "t", "bt":
+	case "text":
+		mode = "t"
+	case "binary":
+		mode = "b"
+	default:
+		return "", fmt.Errorf("invalid file mode %s", mode)
 	}
+	if !env.AllowBinaryChunks {
+		mode = strings.Replace(mode, "b", "", -1)
+		if mode == "" {
+			return "", errors.New("binary chunks are disabled")
+		}
+	}
+	return mode, nil
+}
+
+func LoadFile(l *lua.State, fileName, mode string) error {
 	env, err := GetEnvironment(l)
 	if err != nil {
 		return err
 	}
+	mode, err = chunkMode(env, mode)
+	if err != nil {
+		l.PushString(err.Error())
+		return err
+	}
 	fileNameIndex := l.Top() + 1
 	fileError := func(what string) error {
 		fileName, _ := l.ToString(fileNameIndex)
@@ -103,6 +160,80 @@ func LoadFile(l *lua.State, fileName, mode string) error {
 	return err
 }
 
+// boxLoad is the sandboxed load(chunk [, name [, mode [, env]]]), chunk being a string or a reader function.
+// Like LoadFile it only accepts text chunks unless the environment allows binary chunks
+func boxLoad(l *lua.State) int {
+	env, err := GetEnvironment(l)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	m, e := lua.OptString(l, 3, ""), 4
+	if l.IsNone(e) {
+		e = 0
+	}
+	mode, err := chunkMode(env, m)
+	if err != nil {
+		l.PushString(err.Error())
+		return loadHelper(l, err, e)
+	}
+	if s, ok := l.ToString(1); ok {
+		err = l.Load(strings.NewReader(s), optChunkName(l, 2, s), mode)
+	} else {
+		name := optChunkName(l, 2, "=(load)")
+		lua.CheckType(l, 1, lua.TypeFunction)
+		err = l.Load(&chunkReader{l: l}, name, mode)
+	}
+	return loadHelper(l, err, e)
+}
+
+func optChunkName(l *lua.State, idx int, def string) string {
+	if l.IsNoneOrNil(idx) {
+		return def
+	}
+	name := lua.CheckString(l, idx)
+	if strings.HasPrefix(name, "=") || strings.HasPrefix(name, "@") {
+		return name
+	}
+	return "@" + name
+}
+
+// chunkReader reads a chunk from the reader function at index 1
+type chunkReader struct {
+	l   *lua.State
+	r   *strings.Reader
+	eof bool
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	for r.r == nil || r.r.Len() == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		l := r.l
+		lua.CheckStackWithMessage(l, 2, "too many nested functions")
+		l.PushValue(1)
+		l.Call(0, 1)
+		if l.IsNil(-1) {
+			l.Pop(1)
+			r.eof = true
+			return 0, io.EOF
+		}
+		if !l.IsString(-1) {
+			lua.Errorf(l, "reader function must return a string")
+		}
+		s, _ := l.ToString(-1)
+		l.Pop(1)
+		if s == "" {
+			r.eof = true
+			return 0, io.EOF
+		}
+		r.r = strings.NewReader(s)
+	}
+	return r.r.Read(b)
+}
+
 func skipComment(r *bufio.Reader) (bool, error) {
 	bom := "\xEF\xBB\xBF"
 	if ba, err := r.Peek(len(bom)); err != nil && err != io.EOF {
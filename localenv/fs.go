@@ -56,12 +56,13 @@ func (f *Fs) GetReader(filePath string) (io.ReadCloser, error) {
 	return file, nil
 }
 
+// GetWriter creates or truncates the file, so that writing fewer bytes than an existing file holds leaves no stale data
 func (f *Fs) GetWriter(filePath string) (io.WriteCloser, error) {
 	filePath, err := f.getPath(filePath)
 	if err != nil {
 		return nil, err
 	}
-	file, err := os.OpenFile(filePath, os.O_RDWR, 0600)
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return nil, err
 	}
@@ -1,25 +1,161 @@
 local luabox = require("luabox")
 
-local function toYaml(data)
-    return luabox.yamlRepr(data)
+local function toYaml(data, opts)
+    return luabox.yamlReprWith(opts, data)
 end
 
-local function parseYaml(string)
-    return luabox.yamlParse(string)
+local function parseYaml(string, opts)
+    return luabox.yamlParse(string, opts)
 end
 
-local function toJson(data)
-    return luabox.jsonRepr(data)
+local function toYamlAll(docs, opts)
+    return luabox.yamlReprWith(opts, table.unpack(docs))
 end
 
-local function parseJson(string)
-    return luabox.jsonParse(string)
+local function parseYamlAll(string, opts)
+    return luabox.yamlParseAll(string, opts)
+end
+
+local function yamlDocument(string)
+    return luabox.yamlDocument(string)
+end
+
+local function toJson(data, opts)
+    return luabox.jsonRepr(data, opts)
+end
+
+local function parseJson(string, opts)
+    return luabox.jsonParse(string, opts)
+end
+
+local function jsonRecords(file, opts)
+    return luabox.jsonRecords(file, opts)
+end
+
+local function jsonWriter(file, opts)
+    return luabox.jsonWriter(file, opts)
+end
+
+local function toToml(data)
+    return luabox.tomlRepr(data)
+end
+
+local function parseToml(string)
+    return luabox.tomlParse(string)
+end
+
+local function toCsv(rows, opts)
+    return luabox.csvRepr(rows, opts)
+end
+
+local function parseCsv(string, opts)
+    return luabox.csvParse(string, opts)
+end
+
+local function csvRows(file, opts)
+    return luabox.csvRows(file, opts)
+end
+
+local function toTsv(rows, opts)
+    return luabox.tsvRepr(rows, opts)
+end
+
+local function parseTsv(string, opts)
+    return luabox.tsvParse(string, opts)
+end
+
+local function toIni(data)
+    return luabox.iniRepr(data)
+end
+
+local function parseIni(string)
+    return luabox.iniParse(string)
+end
+
+local function toMsgpack(data)
+    return luabox.msgpackRepr(data)
+end
+
+local function parseMsgpack(string, opts)
+    return luabox.msgpackParse(string, opts)
+end
+
+local function toCbor(data)
+    return luabox.cborRepr(data)
+end
+
+local function parseCbor(string, opts)
+    return luabox.cborParse(string, opts)
+end
+
+local function array(table)
+    return luabox.array(table)
+end
+
+local function object(table)
+    return luabox.object(table)
+end
+
+local function keys(table)
+    return luabox.keys(table)
+end
+
+local function validate(value, schema)
+    return luabox.validate(value, schema)
+end
+
+local function query(value, expr)
+    return luabox.query(value, expr)
+end
+
+local function merge(a, b, opts)
+    return luabox.merge(a, b, opts)
+end
+
+local function mergePatch(value, patch)
+    return luabox.mergePatch(value, patch)
+end
+
+local function diff(a, b)
+    return luabox.diff(a, b)
+end
+
+local function patch(value, ops)
+    return luabox.patch(value, ops)
 end
 
 return {
     toYaml = toYaml,
     fromYaml = parseYaml,
+    toYamlAll = toYamlAll,
+    fromYamlAll = parseYamlAll,
+    yamlDocument = yamlDocument,
     toJson = toJson,
     fromJson = parseJson,
+    jsonRecords = jsonRecords,
+    jsonWriter = jsonWriter,
+    toToml = toToml,
+    fromToml = parseToml,
+    toCsv = toCsv,
+    fromCsv = parseCsv,
+    csvRows = csvRows,
+    toTsv = toTsv,
+    fromTsv = parseTsv,
+    toIni = toIni,
+    fromIni = parseIni,
+    toMsgpack = toMsgpack,
+    fromMsgpack = parseMsgpack,
+    toCbor = toCbor,
+    fromCbor = parseCbor,
+    array = array,
+    object = object,
+    keys = keys,
+    validate = validate,
+    query = query,
+    merge = merge,
+    mergePatch = mergePatch,
+    diff = diff,
+    patch = patch,
+    null = luabox.null,
 }
 
@@ -103,7 +103,7 @@ func genOutInt(idx int) string {
 }
 
 func genOutObject(idx int) string {
-	return fmt.Sprintf("l.PushUserData(o%d)", idx)
+	return fmt.Sprintf("luabox.PushObject(l, o%d)", idx)
 }
 
 func genOutBool(idx int) string {
@@ -123,14 +123,27 @@ func genGetBool(idx int) string {
 }
 
 func genGetObject(idx int, t string) string {
-	return fmt.Sprintf(`lua.CheckAny(l, %d)
-ai%d := l.ToUserData(%d)
-a%d,ok:= ai.(%s)
-if !ok {
-		l.PushString("Expected %s as %d parameter")
-		l.Error()
-		return 0
-}`, idx, idx, idx, idx, t, t, idx)
+	return fmt.Sprintf(`var a%d %s
+luabox.CheckObject(l, %d, &a%d)`, idx, t, idx, idx)
+}
+
+// typeExpr renders identifiers, package qualified identifiers and pointers to them
+func typeExpr(expr ast.Expr) (string, bool) {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return t.Name, true
+	case *ast.SelectorExpr:
+		s, ok := t.X.(*ast.Ident)
+		if ok {
+			return s.Name + "." + t.Sel.Name, true
+		}
+	case *ast.StarExpr:
+		s, ok := typeExpr(t.X)
+		if ok {
+			return "*" + s, true
+		}
+	}
+	return "", false
 }
 
 func main() {
@@ -145,6 +158,7 @@ func main() {
 package {{.Package}}
 
 import "github.com/Shopify/go-lua"
+import "github.com/pujo-j/luabox"
 {{range .Imports -}}
 import{{.Alias}} {{.Path}}
 {{end}}
@@ -186,11 +200,11 @@ if err != nil {
 					Outputs: make([]string, 0),
 				}
 				for idx, par := range fd.Type.Params.List {
-					t, ok := par.Type.(*ast.Ident)
+					t, ok := typeExpr(par.Type)
 					if ok {
 						p := Param{
 							Name: par.Names[0].Name,
-							Type: t.Name,
+							Type: t,
 						}
 						var getParam string
 						switch p.Type {
@@ -204,36 +218,13 @@ if err != nil {
 							getParam = genGetObject(idx+1, p.Type)
 						}
 						f.Params = append(f.Params, getParam)
-					} else {
-						t, ok := par.Type.(*ast.SelectorExpr)
-						if ok {
-							s, ok := t.X.(*ast.Ident)
-							if ok {
-								p := Param{
-									Name: par.Names[0].Name,
-									Type: s.Name + "." + t.Sel.Name,
-								}
-								var getParam string
-								switch p.Type {
-								case "string":
-									getParam = genGetString(idx + 1)
-								case "int":
-									getParam = genGetInt(idx + 1)
-								case "bool":
-									getParam = genGetBool(idx + 1)
-								default:
-									getParam = genGetObject(idx+1, p.Type)
-								}
-								f.Params = append(f.Params, getParam)
-							}
-						}
 					}
 				}
 				if fd.Type.Results != nil {
 					for _, res := range fd.Type.Results.List {
-						t, ok := res.Type.(*ast.Ident)
+						t, ok := typeExpr(res.Type)
 						if ok {
-							f.Outputs = append(f.Outputs, t.Name)
+							f.Outputs = append(f.Outputs, t)
 						}
 					}
 				}
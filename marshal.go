@@ -0,0 +1,336 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Shopify/go-lua"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+var luaFunctionPtrType = reflect.TypeOf(&LuaFunction{})
+
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var structFieldsCache sync.Map
+
+// structFields lists the exported fields of a struct type, named after their lua tag,
+// then their json tag, then their Go name. Embedded structs without a name are flattened.
+func structFields(t reflect.Type) []structField {
+	if cached, ok := structFieldsCache.Load(t); ok {
+		return cached.([]structField)
+	}
+	fields := make([]structField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("lua")
+		if !ok {
+			tag = f.Tag.Get("json")
+		}
+		if tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		name := opts[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for _, embedded := range structFields(f.Type) {
+				embedded.index = append([]int{i}, embedded.index...)
+				fields = append(fields, embedded)
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		field := structField{name: name, index: []int{i}}
+		for _, o := range opts[1:] {
+			if o == "omitempty" {
+				field.omitEmpty = true
+			}
+		}
+		fields = append(fields, field)
+	}
+	structFieldsCache.Store(t, fields)
+	return fields
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return v.Interface().(time.Time).IsZero()
+		}
+	}
+	return false
+}
+
+func (p *pusher) pushStruct(v reflect.Value) {
+	l := p.l
+	fields := structFields(v.Type())
+	l.CreateTable(0, len(fields))
+	for _, f := range fields {
+		fv := v.FieldByIndex(f.index)
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		p.push(fv.Interface(), pathSegment{name: f.name})
+		l.SetField(-2, f.name)
+	}
+}
+
+// PullInto decodes the Lua value at idx into target, which must be a non nil pointer.
+// Tables fill structs, maps, slices and arrays, strings fill []byte and RFC 3339 strings
+// or unix timestamps fill time.Time. Errors are prefixed by the path of the faulty field.
+func PullInto(l *lua.State, idx int, target interface{}) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("pull into: target must be a non nil pointer")
+	}
+	d := &decoder{puller: newPuller(l, environmentPullOptions(l))}
+	return d.decode(l.AbsIndex(idx), rv.Elem(), "$")
+}
+
+type decoder struct {
+	*puller
+	depth int
+}
+
+func (d *decoder) typeError(idx int, path string, expected string) error {
+	return fmt.Errorf("%s: expected %s, got %s", path, expected, lua.TypeNameOf(d.l, idx))
+}
+
+func (d *decoder) decode(idx int, v reflect.Value, path string) error {
+	l := d.l
+	if !l.CheckStack(3) {
+		return fmt.Errorf("%s: stack exhausted", path)
+	}
+	if d.depth >= d.opts.MaxDepth {
+		return fmt.Errorf("%s: maximum depth of %d exceeded", path, d.opts.MaxDepth)
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+	if l.IsNoneOrNil(idx) || IsNull(l, idx) {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if l.TypeOf(idx) == lua.TypeUserData {
+		if ud := l.ToUserData(idx); ud != nil && reflect.TypeOf(ud).AssignableTo(v.Type()) {
+			v.Set(reflect.ValueOf(ud))
+			return nil
+		}
+	}
+	if v.Type() == luaFunctionPtrType {
+		f, err := NewLuaFunction(l, idx)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		v.Set(reflect.ValueOf(f))
+		return nil
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(idx, v.Elem(), path)
+	}
+	if v.Type() == timeType {
+		return d.decodeTime(idx, v, path)
+	}
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("%s: unsupported interface type %s", path, v.Type())
+		}
+		value, err := d.value(idx, path)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(value))
+	case reflect.Bool:
+		if !l.IsBoolean(idx) {
+			return d.typeError(idx, path, "boolean")
+		}
+		v.SetBool(l.ToBoolean(idx))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f, err := d.number(idx, path)
+		if err != nil {
+			return err
+		}
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 || v.OverflowInt(int64(f)) {
+			return fmt.Errorf("%s: %v does not fit in %s", path, f, v.Type())
+		}
+		v.SetInt(int64(f))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		f, err := d.number(idx, path)
+		if err != nil {
+			return err
+		}
+		if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 || v.OverflowUint(uint64(f)) {
+			return fmt.Errorf("%s: %v does not fit in %s", path, f, v.Type())
+		}
+		v.SetUint(uint64(f))
+	case reflect.Float32, reflect.Float64:
+		f, err := d.number(idx, path)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		if l.TypeOf(idx) != lua.TypeString {
+			return d.typeError(idx, path, "string")
+		}
+		s, _ := l.ToString(idx)
+		v.SetString(s)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 && l.TypeOf(idx) == lua.TypeString {
+			s, _ := l.ToString(idx)
+			v.SetBytes([]byte(s))
+			return nil
+		}
+		if !l.IsTable(idx) {
+			return d.typeError(idx, path, "table")
+		}
+		n := lua.LengthEx(l, idx)
+		slice := reflect.MakeSlice(v.Type(), n, n)
+		if err := d.decodeElements(idx, slice, path); err != nil {
+			return err
+		}
+		v.Set(slice)
+	case reflect.Array:
+		if !l.IsTable(idx) {
+			return d.typeError(idx, path, "table")
+		}
+		if n := lua.LengthEx(l, idx); n != v.Len() {
+			return fmt.Errorf("%s: expected %d elements, got %d", path, v.Len(), n)
+		}
+		return d.decodeElements(idx, v, path)
+	case reflect.Map:
+		if !l.IsTable(idx) {
+			return d.typeError(idx, path, "table")
+		}
+		return d.decodeMap(idx, v, path)
+	case reflect.Struct:
+		if !l.IsTable(idx) {
+			return d.typeError(idx, path, "table")
+		}
+		for _, f := range structFields(v.Type()) {
+			l.Field(idx, f.name)
+			err := d.decode(l.Top(), v.FieldByIndex(f.index), path+"."+f.name)
+			l.Pop(1)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s: unsupported type %s", path, v.Type())
+	}
+	return nil
+}
+
+func (d *decoder) number(idx int, path string) (float64, error) {
+	if d.l.TypeOf(idx) != lua.TypeNumber {
+		return 0, d.typeError(idx, path, "number")
+	}
+	f, _ := d.l.ToNumber(idx)
+	return f, nil
+}
+
+func (d *decoder) decodeTime(idx int, v reflect.Value, path string) error {
+	switch d.l.TypeOf(idx) {
+	case lua.TypeString:
+		s, _ := d.l.ToString(idx)
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		v.Set(reflect.ValueOf(t))
+	case lua.TypeNumber:
+		f, _ := d.l.ToNumber(idx)
+		sec, frac := math.Modf(f)
+		v.Set(reflect.ValueOf(time.Unix(int64(sec), int64(frac*1e9)).UTC()))
+	default:
+		return d.typeError(idx, path, "RFC 3339 string or unix timestamp")
+	}
+	return nil
+}
+
+func (d *decoder) decodeElements(idx int, v reflect.Value, path string) error {
+	l := d.l
+	for i := 0; i < v.Len(); i++ {
+		l.RawGetInt(idx, i+1)
+		err := d.decode(l.Top(), v.Index(i), fmt.Sprintf("%s[%d]", path, i+1))
+		l.Pop(1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *decoder) decodeMap(idx int, v reflect.Value, path string) error {
+	l := d.l
+	t := v.Type()
+	m := reflect.MakeMap(t)
+	l.PushNil()
+	for l.Next(idx) {
+		key := reflect.New(t.Key()).Elem()
+		if err := d.decode(l.AbsIndex(-2), key, path+"[key]"); err != nil {
+			l.Pop(2)
+			return err
+		}
+		elemPath := fmt.Sprintf("%s[%v]", path, key.Interface())
+		if key.Kind() == reflect.String {
+			elemPath = path + "." + key.String()
+		}
+		value := reflect.New(t.Elem()).Elem()
+		if err := d.decode(l.AbsIndex(-1), value, elemPath); err != nil {
+			l.Pop(2)
+			return err
+		}
+		m.SetMapIndex(key, value)
+		l.Pop(1)
+	}
+	v.Set(m)
+	return nil
+}
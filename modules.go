@@ -0,0 +1,145 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/Shopify/go-lua"
+	"hash/fnv"
+	"path"
+	"time"
+)
+
+const modulesKey = "LUABOX_MODULES"
+
+// ModuleLoad records one require of a module by a state
+type ModuleLoad struct {
+	Name string
+	// Parent is the module whose loading required this one, empty at top level
+	Parent string
+	// Searcher is the searcher that found the module: preload, libs or filesystem
+	Searcher string
+	File     string
+	ETag     string
+	Start    time.Time
+	Duration time.Duration
+	// Error is set when the module could not be found or failed to load
+	Error string
+}
+
+type moduleTrace struct {
+	loads   []ModuleLoad
+	loading []string
+	found   ModuleLoad
+}
+
+func getModuleTrace(l *lua.State) *moduleTrace {
+	l.Field(lua.RegistryIndex, modulesKey)
+	trace, ok := l.ToUserData(-1).(*moduleTrace)
+	l.Pop(1)
+	if !ok {
+		trace = &moduleTrace{}
+		l.PushUserData(trace)
+		l.SetField(lua.RegistryIndex, modulesKey)
+	}
+	return trace
+}
+
+// foundModule is called by the searchers to record where a module comes from
+func foundModule(l *lua.State, searcher, file, etag string) {
+	getModuleTrace(l).found = ModuleLoad{Searcher: searcher, File: file, ETag: etag}
+}
+
+// Modules returns the modules required by a state initialized by the environment, in loading order,
+// or nil when the state belongs to another environment
+func (e *Environment) Modules(l *lua.State) []ModuleLoad {
+	if env, ok := lookupEnvironment(l); !ok || env != e {
+		return nil
+	}
+	loads := getModuleTrace(l).loads
+	res := make([]ModuleLoad, len(loads))
+	copy(res, loads)
+	return res
+}
+
+func (t *moduleTrace) begin(name string) int {
+	load := ModuleLoad{Name: name, Start: time.Now()}
+	if len(t.loading) > 0 {
+		load.Parent = t.loading[len(t.loading)-1]
+	}
+	t.loads = append(t.loads, load)
+	t.loading = append(t.loading, name)
+	t.found = ModuleLoad{}
+	return len(t.loads) - 1
+}
+
+func (t *moduleTrace) end(i int, err string) {
+	t.loading = t.loading[:len(t.loading)-1]
+	load := &t.loads[i]
+	load.Duration = time.Since(load.Start)
+	load.Error = err
+}
+
+func (t *moduleTrace) setFound(i int) {
+	load := &t.loads[i]
+	load.Searcher = t.found.Searcher
+	load.File = t.found.File
+	load.ETag = t.found.ETag
+}
+
+func codeETag(code string) string {
+	etag := fnv.New64a()
+	_, err := etag.Write([]byte(code))
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(etag.Sum([]byte{}))
+}
+
+func fileETag(fs Filesystem, file string) (string, error) {
+	list, err := fs.List(path.Dir(file))
+	if err != nil {
+		return "", err
+	}
+	for _, info := range list {
+		if info.Name == path.Base(file) {
+			return info.ETag, nil
+		}
+	}
+	return "", errors.New("file not listed: " + file)
+}
+
+func EnvGetModules(l *lua.State) int {
+	trace := getModuleTrace(l)
+	res := make([]interface{}, len(trace.loads))
+	for i, load := range trace.loads {
+		res[i] = map[string]interface{}{
+			"name":     load.Name,
+			"parent":   load.Parent,
+			"searcher": load.Searcher,
+			"file":     load.File,
+			"etag":     load.ETag,
+			"start":    load.Start.Format(time.RFC3339Nano),
+			"duration": load.Duration.Seconds(),
+			"error":    load.Error,
+		}
+	}
+	DeepPush(l, res)
+	return 1
+}
@@ -0,0 +1,56 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import "github.com/Shopify/go-lua"
+
+const nullKey = "LUABOX_NULL"
+
+type nullValue struct{}
+
+// Null is the Go value of luabox.null, the Lua stand-in for the JSON and YAML nulls that nil cannot hold in tables
+var Null = &nullValue{}
+
+func (n *nullValue) String() string {
+	return "null"
+}
+
+// PushNull pushes luabox.null, the same userdata being pushed each time so that it compares equal
+func PushNull(l *lua.State) {
+	l.Field(lua.RegistryIndex, nullKey)
+	if !l.IsNil(-1) {
+		return
+	}
+	l.Pop(1)
+	l.PushUserData(Null)
+	lua.NewMetaTable(l, "luabox:null")
+	lua.SetFunctions(l, []lua.RegistryFunction{
+		{"__tostring", func(l *lua.State) int {
+			l.PushString("null")
+			return 1
+		}},
+	}, 0)
+	l.SetMetaTable(-2)
+	l.PushValue(-1)
+	l.SetField(lua.RegistryIndex, nullKey)
+}
+
+// IsNull returns true if the value at idx is luabox.null
+func IsNull(l *lua.State, idx int) bool {
+	return l.ToUserData(idx) == Null
+}
@@ -0,0 +1,414 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Shopify/go-lua"
+	"gopkg.in/yaml.v3"
+	"io"
+	"reflect"
+	"sort"
+)
+
+// TableOrderField is the metatable field listing the keys of a table in their original order
+const TableOrderField = "__luabox_order"
+
+// MapItem is an entry of an OrderedMap
+type MapItem struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// OrderedMap is a map keeping the order of its keys.
+// Ordered decoders produce it, and it is pushed as a table recording its key order in its metatable.
+type OrderedMap []MapItem
+
+func (m OrderedMap) MarshalJSON() ([]byte, error) {
+	b := bytes.NewBufferString("{")
+	for i, item := range m {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, err := marshalJSON(fmt.Sprint(item.Key))
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		value, err := marshalJSON(item.Value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// marshalJSON leaves HTML escaping to the encoder embedding the result, which applies its own setting
+func marshalJSON(v interface{}) ([]byte, error) {
+	b := &bytes.Buffer{}
+	encoder := json.NewEncoder(b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+func (m OrderedMap) MarshalYAML() (interface{}, error) {
+	n := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, item := range m {
+		key, err := yamlNode(item.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := yamlNode(item.Value)
+		if err != nil {
+			return nil, err
+		}
+		n.Content = append(n.Content, key, value)
+	}
+	return n, nil
+}
+
+// yamlNode converts a value to a YAML node, going through its encoding for values other than
+// ordered maps and sequences
+func yamlNode(v interface{}) (*yaml.Node, error) {
+	switch v := v.(type) {
+	case *yaml.Node:
+		return v, nil
+	case OrderedMap:
+		n, err := v.MarshalYAML()
+		if err != nil {
+			return nil, err
+		}
+		return n.(*yaml.Node), nil
+	case []interface{}:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, e := range v {
+			c, err := yamlNode(e)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, c)
+		}
+		return n, nil
+	}
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc.Content[0], nil
+}
+
+// mapItems returns the entries of a map pulled from Lua, in their recorded order or sorted by key
+func mapItems(v interface{}) (OrderedMap, bool) {
+	switch v := v.(type) {
+	case OrderedMap:
+		return v, true
+	case map[string]interface{}:
+		m := make(OrderedMap, 0, len(v))
+		for k, e := range v {
+			m = append(m, MapItem{Key: k, Value: e})
+		}
+		sort.Slice(m, func(i, j int) bool { return m[i].Key.(string) < m[j].Key.(string) })
+		return m, true
+	case map[interface{}]interface{}:
+		m := make(OrderedMap, 0, len(v))
+		for k, e := range v {
+			m = append(m, MapItem{Key: k, Value: e})
+		}
+		sort.Slice(m, func(i, j int) bool { return fmt.Sprint(m[i].Key) < fmt.Sprint(m[j].Key) })
+		return m, true
+	}
+	return nil, false
+}
+
+// orderedKeys pushes an array of the keys of the table at idx: first the recorded ones still present,
+// then the others sorted. It returns the number of keys.
+func orderedKeys(l *lua.State, idx int) int {
+	idx = l.AbsIndex(idx)
+	l.NewTable()
+	keys := l.Top()
+	n := 0
+	seen := make(map[string]bool)
+	if lua.MetaField(l, idx, TableOrderField) {
+		order := l.Top()
+		for i := 1; i <= l.RawLength(order); i++ {
+			l.RawGetInt(order, i)
+			l.PushValue(-1)
+			l.RawGet(idx)
+			present := !l.IsNil(-1)
+			l.Pop(1)
+			k, ok := keyString(l, -1)
+			if !present || !ok || seen[k] {
+				l.Pop(1)
+				continue
+			}
+			seen[k] = true
+			n++
+			l.RawSetInt(keys, n)
+		}
+		l.Pop(1)
+	}
+	l.NewTable()
+	others := l.Top()
+	rest := make([]string, 0)
+	l.PushNil()
+	for l.Next(idx) {
+		l.Pop(1)
+		k, ok := keyString(l, -1)
+		if !ok || seen[k] {
+			continue
+		}
+		seen[k] = true
+		rest = append(rest, k)
+		l.PushValue(-1)
+		l.SetField(others, k)
+	}
+	sort.Strings(rest)
+	for _, k := range rest {
+		l.Field(others, k)
+		n++
+		l.RawSetInt(keys, n)
+	}
+	l.Pop(1)
+	return n
+}
+
+func (p *puller) ordered(idx int, path string) (interface{}, error) {
+	l := p.l
+	n := orderedKeys(l, idx)
+	keys := l.Top()
+	defer l.Remove(keys)
+	table := make(OrderedMap, 0, n)
+	for i := 1; i <= n; i++ {
+		l.RawGetInt(keys, i)
+		s, _ := keyString(l, -1)
+		var key interface{} = s
+		if p.opts.Keys == KeysInterface {
+			switch l.TypeOf(-1) {
+			case lua.TypeNumber:
+				f, _ := l.ToNumber(-1)
+				key = goNumber(f, p.opts.Numbers)
+			case lua.TypeBoolean:
+				key = l.ToBoolean(-1)
+			}
+		}
+		l.RawGet(idx)
+		value, err := p.value(-1, path+"."+s)
+		l.Pop(1)
+		if err != nil {
+			return nil, err
+		}
+		table = append(table, MapItem{Key: key, Value: value})
+	}
+	return table, nil
+}
+
+func (p *pusher) pushOrdered(m OrderedMap) {
+	l := p.l
+	defer p.enter(reflect.ValueOf(m))()
+	l.CreateTable(0, len(m))
+	l.CreateTable(0, 2)
+	l.PushString(TableObject)
+	l.SetField(-2, TableTypeField)
+	l.CreateTable(len(m), 0)
+	for i, item := range m {
+		p.push(item.Key, pathSegment{isKey: true})
+		l.RawSetInt(-2, i+1)
+	}
+	l.SetField(-2, TableOrderField)
+	l.SetMetaTable(-2)
+	for _, item := range m {
+		p.push(item.Key, pathSegment{isKey: true})
+		p.push(item.Value, pathSegment{key: item.Key})
+		l.RawSet(-3)
+	}
+}
+
+// TableKeys returns the keys of the table argument in their recorded order, followed by the other keys sorted
+func TableKeys(l *lua.State) int {
+	lua.CheckType(l, 1, lua.TypeTable)
+	orderedKeys(l, 1)
+	return 1
+}
+
+// orderedJSON decodes the next JSON value of dec, objects becoming OrderedMap
+func orderedJSON(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		m := make(OrderedMap, 0)
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := orderedJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, MapItem{Key: key, Value: value})
+		}
+		_, err = dec.Token()
+		return m, err
+	case json.Delim('['):
+		a := make([]interface{}, 0)
+		for dec.More() {
+			value, err := orderedJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, value)
+		}
+		_, err = dec.Token()
+		return a, err
+	}
+	return tok, nil
+}
+
+func unmarshalOrderedJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	v, err := orderedJSON(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid data after top-level JSON value")
+	}
+	return v, nil
+}
+
+// maxYAMLAliasNodes bounds the number of nodes expanded from aliases, like the yaml.v3 decoder does
+// against documents made of nested aliases
+const maxYAMLAliasNodes = 100000
+
+// orderedYAML converts a YAML node, mappings becoming OrderedMap
+func orderedYAML(n *yaml.Node) (interface{}, error) {
+	return (&yamlExpander{}).value(n, false)
+}
+
+// yamlExpander counts the nodes expanded from aliases
+type yamlExpander struct {
+	aliased int
+}
+
+func (e *yamlExpander) value(n *yaml.Node, aliased bool) (interface{}, error) {
+	if aliased {
+		e.aliased++
+		if e.aliased > maxYAMLAliasNodes {
+			return nil, fmt.Errorf("line %d: document expands to more than %d nodes through aliases", n.Line, maxYAMLAliasNodes)
+		}
+	}
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil, nil
+		}
+		return e.value(n.Content[0], aliased)
+	case yaml.AliasNode:
+		return e.value(n.Alias, true)
+	case yaml.SequenceNode:
+		a := make([]interface{}, 0, len(n.Content))
+		for _, c := range n.Content {
+			value, err := e.value(c, aliased)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, value)
+		}
+		return a, nil
+	case yaml.MappingNode:
+		return e.mapping(n, aliased)
+	}
+	var v interface{}
+	err := n.Decode(&v)
+	return v, err
+}
+
+func (e *yamlExpander) mapping(n *yaml.Node, aliased bool) (OrderedMap, error) {
+	m := make(OrderedMap, 0, len(n.Content)/2)
+	index := make(map[string]int)
+	// explicit keys win over merged ones, wherever the merge key is, and earlier merged mappings over later ones
+	set := func(key, value interface{}, override bool) {
+		k := fmt.Sprint(key)
+		if i, ok := index[k]; ok {
+			if override {
+				m[i].Value = value
+			}
+			return
+		}
+		index[k] = len(m)
+		m = append(m, MapItem{Key: key, Value: value})
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		keyNode, valueNode := n.Content[i], n.Content[i+1]
+		value, err := e.value(valueNode, aliased)
+		if err != nil {
+			return nil, err
+		}
+		if keyNode.Tag == "!!merge" {
+			sources, ok := value.([]interface{})
+			if !ok {
+				sources = []interface{}{value}
+			}
+			for _, source := range sources {
+				sm, ok := source.(OrderedMap)
+				if !ok {
+					return nil, fmt.Errorf("line %d: merge of a non mapping value", keyNode.Line)
+				}
+				for _, item := range sm {
+					set(item.Key, item.Value, false)
+				}
+			}
+			continue
+		}
+		var key interface{}
+		if err := keyNode.Decode(&key); err != nil {
+			return nil, err
+		}
+		set(key, value, true)
+	}
+	return m, nil
+}
+
+// yamlDocument converts a decoded YAML document, keeping key order when ordered
+func yamlDocument(n *yaml.Node, ordered bool) (interface{}, error) {
+	if ordered {
+		return orderedYAML(n)
+	}
+	var v interface{}
+	if n.Kind == 0 {
+		return nil, nil
+	}
+	err := n.Decode(&v)
+	return v, err
+}
@@ -76,7 +76,11 @@ func searcherLua(l *lua.State) int {
 	if err != nil {
 		return 1 // Module not found in this path.
 	}
-	return checkLoad(l, LoadFile(l, filename, "text") == nil, filename)
+	if env, err := GetEnvironment(l); err == nil {
+		etag, _ := fileETag(env.Fs, filename)
+		foundModule(l, "filesystem", filename, etag)
+	}
+	return checkLoad(l, LoadFile(l, filename, "") == nil, filename)
 }
 
 func searcherLibs(l *lua.State) int {
@@ -89,7 +93,7 @@ func searcherLibs(l *lua.State) int {
 	if !ok {
 		return 1
 	}
-
+	foundModule(l, "libs", file.Name, codeETag(file.Code))
 	return checkLoad(l, LoadLuaFile(l, file) == nil, file.Name)
 }
 
@@ -99,6 +103,8 @@ func searcherPreload(l *lua.State) int {
 	l.Field(-1, name)
 	if l.IsNil(-1) {
 		l.PushString(fmt.Sprintf("\n\tno field package.preload['%s']", name))
+	} else {
+		foundModule(l, "preload", "", "")
 	}
 	return 1
 }
@@ -208,10 +214,22 @@ func PackageOpen(l *lua.State) int {
 			return 1
 		}
 		l.Pop(1)
+		trace := getModuleTrace(l)
+		load := trace.begin(name)
+		failed := true
+		defer func() {
+			if failed {
+				msg, _ := l.ToString(-1)
+				trace.end(load, msg)
+			}
+		}()
 		findLoader(l, name)
+		trace.setFound(load)
 		l.PushString(name)
 		l.Insert(-2)
 		l.Call(2, 1)
+		failed = false
+		trace.end(load, "")
 		if !l.IsNil(-1) {
 			l.SetField(2, name)
 		}
@@ -0,0 +1,601 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Shopify/go-lua"
+	"strconv"
+	"strings"
+)
+
+// Array merge strategies
+const (
+	MergeReplace = "replace"
+	MergeAppend  = "append"
+	MergeByKey   = "by-key"
+)
+
+// MergeOptions tunes MergeValues: Arrays is the array strategy, replace by default,
+// Key the member identifying the elements of arrays of objects merged by key
+type MergeOptions struct {
+	Arrays string
+	Key    string
+}
+
+// PatchOperation is a RFC 6902 JSON Patch operation, paths being RFC 6901 JSON pointers
+type PatchOperation struct {
+	Op    string
+	Path  string
+	From  string
+	Value interface{}
+}
+
+// normalize copies a value, objects becoming OrderedMap so that all containers can be edited the same way
+func normalize(v interface{}) interface{} {
+	if a, ok := v.([]interface{}); ok {
+		res := make([]interface{}, len(a))
+		for i, e := range a {
+			res[i] = normalize(e)
+		}
+		return res
+	}
+	if items, ok := mapItems(v); ok {
+		res := make(OrderedMap, len(items))
+		for i, item := range items {
+			res[i] = MapItem{Key: item.Key, Value: normalize(item.Value)}
+		}
+		return res
+	}
+	return v
+}
+
+func itemIndex(m OrderedMap, key string) int {
+	for i, item := range m {
+		if fmt.Sprint(item.Key) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// keyIndex indexes the keys of an object by their string form
+func keyIndex(m OrderedMap) map[string]int {
+	index := make(map[string]int, len(m))
+	for i, item := range m {
+		index[fmt.Sprint(item.Key)] = i
+	}
+	return index
+}
+
+// asArray returns an array, or an empty object which Lua cannot tell from an empty array, as an array
+func asArray(v interface{}) ([]interface{}, bool) {
+	if a, ok := v.([]interface{}); ok {
+		return a, true
+	}
+	if m, ok := v.(OrderedMap); ok && len(m) == 0 {
+		return []interface{}{}, true
+	}
+	return nil, false
+}
+
+// bothArrays returns a and b as arrays when one is an array and the other an array or an empty object
+func bothArrays(a, b interface{}) ([]interface{}, []interface{}, bool) {
+	_, aArray := a.([]interface{})
+	_, bArray := b.([]interface{})
+	if !aArray && !bArray {
+		return nil, nil, false
+	}
+	aa, aok := asArray(a)
+	ab, bok := asArray(b)
+	return aa, ab, aok && bok
+}
+
+// MergeValues deep merges b into a: objects are merged recursively, arrays following the strategy
+// of the options and other values of b replace those of a. Neither a nor b is modified.
+func MergeValues(a, b interface{}, opts MergeOptions) (interface{}, error) {
+	switch opts.Arrays {
+	case "", MergeReplace, MergeAppend:
+	case MergeByKey:
+		if opts.Key == "" {
+			return nil, errors.New("merge: the by-key strategy requires a key")
+		}
+	default:
+		return nil, fmt.Errorf("merge: unknown array strategy %q", opts.Arrays)
+	}
+	return mergeValues(normalize(a), normalize(b), opts), nil
+}
+
+// mergeValues merges normalized values, reusing and modifying them
+func mergeValues(a, b interface{}, opts MergeOptions) interface{} {
+	aa, ab, arrays := bothArrays(a, b)
+	if !arrays {
+		ma, aok := a.(OrderedMap)
+		mb, bok := b.(OrderedMap)
+		if !aok || !bok {
+			return b
+		}
+		index := keyIndex(ma)
+		for _, item := range mb {
+			k := fmt.Sprint(item.Key)
+			if i, ok := index[k]; ok {
+				ma[i].Value = mergeValues(ma[i].Value, item.Value, opts)
+			} else {
+				index[k] = len(ma)
+				ma = append(ma, item)
+			}
+		}
+		return ma
+	}
+	switch opts.Arrays {
+	case MergeAppend:
+		return append(aa, ab...)
+	case MergeByKey:
+		index := make(map[string]int, len(aa))
+		for i, e := range aa {
+			if key, ok := queryMember(e, opts.Key); ok {
+				index[mergeKey(key)] = i
+			}
+		}
+		for _, e := range ab {
+			if key, ok := queryMember(e, opts.Key); ok {
+				if i, ok := index[mergeKey(key)]; ok {
+					aa[i] = mergeValues(aa[i], e, opts)
+					continue
+				}
+				index[mergeKey(key)] = len(aa)
+			}
+			aa = append(aa, e)
+		}
+		return aa
+	}
+	return ab
+}
+
+// mergeKey identifies an array element merged by key, numbers being compared by value
+func mergeKey(key interface{}) string {
+	if n, ok := numberOf(key); ok {
+		return "n" + strconv.FormatFloat(n, 'g', -1, 64)
+	}
+	return fmt.Sprintf("%T:%v", key, key)
+}
+
+// ApplyMergePatch applies a RFC 7386 merge patch to v, null members of the patch removing those of v
+func ApplyMergePatch(v, patch interface{}) interface{} {
+	return mergePatch(normalize(v), normalize(patch))
+}
+
+// mergePatch applies a normalized patch to a normalized value, reusing and modifying them
+func mergePatch(v, patch interface{}) interface{} {
+	mp, ok := patch.(OrderedMap)
+	if !ok {
+		return patch
+	}
+	if _, ok := v.([]interface{}); ok && len(mp) == 0 {
+		return []interface{}{}
+	}
+	res, ok := v.(OrderedMap)
+	if !ok {
+		res = OrderedMap{}
+	}
+	index := keyIndex(res)
+	removed := 0
+	for _, item := range mp {
+		k := fmt.Sprint(item.Key)
+		i, exists := index[k]
+		switch {
+		case item.Value == nil && exists:
+			// Lua keys are never nil, marking the item as removed
+			res[i].Key = nil
+			delete(index, k)
+			removed++
+		case item.Value == nil:
+		case exists:
+			res[i].Value = mergePatch(res[i].Value, item.Value)
+		default:
+			index[k] = len(res)
+			res = append(res, MapItem{Key: item.Key, Value: mergePatch(nil, item.Value)})
+		}
+	}
+	if removed > 0 {
+		kept := res[:0]
+		for _, item := range res {
+			if item.Key != nil {
+				kept = append(kept, item)
+			}
+		}
+		res = kept
+	}
+	return res
+}
+
+// DiffValues returns the RFC 6902 operations turning a into b
+func DiffValues(a, b interface{}) []PatchOperation {
+	return diffValues(normalize(a), normalize(b), "", make([]PatchOperation, 0))
+}
+
+func diffValues(a, b interface{}, path string, ops []PatchOperation) []PatchOperation {
+	if aa, ab, ok := bothArrays(a, b); ok {
+		common := len(aa)
+		if len(ab) < common {
+			common = len(ab)
+		}
+		for i := 0; i < common; i++ {
+			ops = diffValues(aa[i], ab[i], path+"/"+strconv.Itoa(i), ops)
+		}
+		for i := len(aa) - 1; i >= common; i-- {
+			ops = append(ops, PatchOperation{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+		}
+		for i := common; i < len(ab); i++ {
+			ops = append(ops, PatchOperation{Op: "add", Path: path + "/" + strconv.Itoa(i), Value: ab[i]})
+		}
+		return ops
+	}
+	if ma, ok := a.(OrderedMap); ok {
+		if mb, ok := b.(OrderedMap); ok {
+			ia, ib := keyIndex(ma), keyIndex(mb)
+			for _, item := range ma {
+				key := fmt.Sprint(item.Key)
+				if _, ok := ib[key]; !ok {
+					ops = append(ops, PatchOperation{Op: "remove", Path: path + "/" + pointerEscape(key)})
+				}
+			}
+			for _, item := range mb {
+				key := fmt.Sprint(item.Key)
+				at := path + "/" + pointerEscape(key)
+				if i, ok := ia[key]; ok {
+					ops = diffValues(ma[i].Value, item.Value, at, ops)
+				} else {
+					ops = append(ops, PatchOperation{Op: "add", Path: at, Value: item.Value})
+				}
+			}
+			return ops
+		}
+	}
+	if !jsonEqual(a, b) {
+		ops = append(ops, PatchOperation{Op: "replace", Path: path, Value: b})
+	}
+	return ops
+}
+
+// pointerTokens splits a JSON pointer into its unescaped reference tokens
+func pointerTokens(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayPosition parses an array index token, "-" designating the end when allowed
+func arrayPosition(token string, length int, end bool) (int, error) {
+	if token == "-" && end {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	max := length - 1
+	if end {
+		max = length
+	}
+	if i > max {
+		return 0, fmt.Errorf("array index %d out of bounds", i)
+	}
+	return i, nil
+}
+
+func pointerGet(v interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch c := v.(type) {
+		case OrderedMap:
+			i := itemIndex(c, token)
+			if i < 0 {
+				return nil, fmt.Errorf("missing member %q", token)
+			}
+			v = c[i].Value
+		case []interface{}:
+			i, err := arrayPosition(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			v = c[i]
+		default:
+			return nil, fmt.Errorf("cannot reference %q in %s", token, jsonType(v))
+		}
+	}
+	return v, nil
+}
+
+// pointerUpdate replaces the parent of the last token in v by the result of fn, modifying v in place
+func pointerUpdate(v interface{}, tokens []string, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fn(v, tokens[0])
+	}
+	child, err := pointerGet(v, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = pointerUpdate(child, tokens[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+	return pointerSet(v, tokens[0], child, false)
+}
+
+// isIndexToken tells whether a token designates an array element
+func isIndexToken(token string) bool {
+	if token == "-" {
+		return true
+	}
+	_, err := strconv.Atoi(token)
+	return err == nil
+}
+
+// pointerSet sets a member or an array element, inserting it when insert is set.
+// An empty object, which Lua cannot tell from an empty array, is an array for index tokens.
+func pointerSet(parent interface{}, token string, v interface{}, insert bool) (interface{}, error) {
+	if m, ok := parent.(OrderedMap); ok && len(m) == 0 && isIndexToken(token) {
+		parent = []interface{}{}
+	}
+	switch c := parent.(type) {
+	case OrderedMap:
+		if i := itemIndex(c, token); i >= 0 {
+			c[i].Value = v
+			return c, nil
+		}
+		if !insert {
+			return nil, fmt.Errorf("missing member %q", token)
+		}
+		return append(c, MapItem{Key: token, Value: v}), nil
+	case []interface{}:
+		i, err := arrayPosition(token, len(c), insert)
+		if err != nil {
+			return nil, err
+		}
+		if !insert {
+			c[i] = v
+			return c, nil
+		}
+		c = append(c, nil)
+		copy(c[i+1:], c[i:])
+		c[i] = v
+		return c, nil
+	}
+	return nil, fmt.Errorf("cannot set %q in %s", token, jsonType(parent))
+}
+
+func pointerRemove(parent interface{}, token string) (interface{}, error) {
+	switch c := parent.(type) {
+	case OrderedMap:
+		i := itemIndex(c, token)
+		if i < 0 {
+			return nil, fmt.Errorf("missing member %q", token)
+		}
+		return append(c[:i], c[i+1:]...), nil
+	case []interface{}:
+		i, err := arrayPosition(token, len(c), false)
+		if err != nil {
+			return nil, err
+		}
+		return append(c[:i], c[i+1:]...), nil
+	}
+	return nil, fmt.Errorf("cannot remove %q from %s", token, jsonType(parent))
+}
+
+func patchAdd(doc interface{}, tokens []string, v interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return v, nil
+	}
+	return pointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		return pointerSet(parent, token, v, true)
+	})
+}
+
+func patchRemove(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("cannot remove the whole document")
+	}
+	return pointerUpdate(doc, tokens, pointerRemove)
+}
+
+// ApplyPatch applies RFC 6902 operations to v, returning the patched document or the error of the first failing operation
+func ApplyPatch(v interface{}, ops []PatchOperation) (interface{}, error) {
+	doc := normalize(v)
+	for i, op := range ops {
+		var err error
+		doc, err = applyOperation(doc, op)
+		if err != nil {
+			return nil, fmt.Errorf("patch: operation %d (%s %s): %v", i+1, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func applyOperation(doc interface{}, op PatchOperation) (interface{}, error) {
+	tokens, err := pointerTokens(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case "add":
+		return patchAdd(doc, tokens, normalize(op.Value))
+	case "remove":
+		return patchRemove(doc, tokens)
+	case "replace":
+		if len(tokens) == 0 {
+			return normalize(op.Value), nil
+		}
+		return pointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+			return pointerSet(parent, token, normalize(op.Value), false)
+		})
+	case "move", "copy":
+		from, err := pointerTokens(op.From)
+		if err != nil {
+			return nil, err
+		}
+		v, err := pointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if op.Path != op.From && strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, errors.New("cannot move a value into itself")
+			}
+			if doc, err = patchRemove(doc, from); err != nil {
+				return nil, err
+			}
+		}
+		return patchAdd(doc, tokens, normalize(v))
+	case "test":
+		v, err := pointerGet(doc, tokens)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(v, op.Value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown operation %q", op.Op)
+}
+
+// patchOperations reads the operations pulled from a Lua array of {op, path, from, value} tables
+func patchOperations(v interface{}) ([]PatchOperation, error) {
+	list, ok := arrayOf(v)
+	if !ok {
+		return nil, errors.New("patch: operations must be an array")
+	}
+	ops := make([]PatchOperation, len(list))
+	for i, e := range list {
+		m, ok := objectOf(e)
+		if !ok {
+			return nil, fmt.Errorf("patch: operation %d is not an object", i+1)
+		}
+		op, _ := stringOf(m["op"])
+		path, hasPath := stringOf(m["path"])
+		from, _ := stringOf(m["from"])
+		if op == "" || !hasPath {
+			return nil, fmt.Errorf("patch: operation %d needs op and path", i+1)
+		}
+		ops[i] = PatchOperation{Op: op, Path: path, From: from, Value: m["value"]}
+	}
+	return ops, nil
+}
+
+func pullPatchValues(l *lua.State, n int) ([]interface{}, error) {
+	p := newPuller(l, encoderPullOptions(l))
+	values := make([]interface{}, n)
+	for i := range values {
+		v, err := p.value(i+1, "$")
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// Merge deep merges its second argument into its first one, the options table giving the
+// array strategy, arrays = "replace", "append" or "by-key", and the key of the by-key strategy
+func Merge(l *lua.State) int {
+	values, err := pullPatchValues(l, 2)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	opts := MergeOptions{}
+	if l.IsTable(3) {
+		l.Field(3, "arrays")
+		opts.Arrays, _ = l.ToString(-1)
+		l.Field(3, "key")
+		opts.Key, _ = l.ToString(-1)
+		l.Pop(2)
+	}
+	res, err := MergeValues(values[0], values[1], opts)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	DeepPushWith(l, res, PushOptions{Nulls: true})
+	return 1
+}
+
+// MergePatch applies the RFC 7386 merge patch given as second argument to its first argument
+func MergePatch(l *lua.State) int {
+	values, err := pullPatchValues(l, 2)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	DeepPushWith(l, ApplyMergePatch(values[0], values[1]), PushOptions{Nulls: true})
+	return 1
+}
+
+// Diff returns the array of RFC 6902 operations turning its first argument into its second one
+func Diff(l *lua.State) int {
+	values, err := pullPatchValues(l, 2)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	ops := DiffValues(values[0], values[1])
+	res := make([]interface{}, len(ops))
+	for i, op := range ops {
+		m := OrderedMap{{Key: "op", Value: op.Op}, {Key: "path", Value: op.Path}}
+		if op.Op != "remove" {
+			m = append(m, MapItem{Key: "value", Value: op.Value})
+		}
+		res[i] = m
+	}
+	DeepPushWith(l, res, PushOptions{Nulls: true})
+	return 1
+}
+
+// Patch applies the array of RFC 6902 operations given as second argument to its first argument
+func Patch(l *lua.State) int {
+	values, err := pullPatchValues(l, 2)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	ops, err := patchOperations(values[1])
+	if err == nil {
+		values[0], err = ApplyPatch(values[0], ops)
+	}
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	DeepPushWith(l, values[0], PushOptions{Nulls: true})
+	return 1
+}
@@ -9,4 +9,4 @@ import (
 	"github.com/markbates/pkger/pkging/mem"
 )
 
-var _ = pkger.Apply(mem.UnmarshalEmbed([]byte(`1f8b08000000000000ffec59eb6fe23a16ff572a7f5d86bc5b82b41f5a7a4b693bd51d3a0385ede8ca494ce2e247d676807434fffbca7940e814e8ceecd5de2bf1017c5e3ef639f1f9d996bf01cc665c82ee3710639564413be4d448b367fee1d920190cf84aeb2eb1005d70d97d7a4a057f46a1924f4fa5d6062d30a02917ea77a812d0ddeda605ee2145a00bd6fc250f41178016f80c458c54490f39577bc6fa08559880eebf401b7c6d81070509025d2532543143042567a00b1857279849050941d14990a913b88098c080a013cc4e820c93e824846182400bf4f91526486abf015f85909076cc410b20b628899956e752215af2040799c244561c87514dc52591c2700e6354310233559202a5a2a41afd17b382f85aa7b29c4836c35a19e40a49d00221670aad5431ab904798c54682564df65947de0248082e748f19d5d68d0ff290f014cf7223e61f4806b775148a79001592463a8f91d04a9ecee33666460e29692f1cd00209948931630bd002c5dc303730d7818016e0b2085b25864e96268a706704857a1a528990173da51298c5da5a618a74d49728dd11324d0592d29811a8505310bfe0b4ca09c40c098360a9b692148a3c557c4d18b0f45832214e9322c68a8f9aca48c20d83c26d36b23dcff27f10189829241824068a965044f2b51921385538dc48120a1bdcbabb802caa12fa5a25b34011b451d0c8db30ba5f830bdd06d30c4026d0dae26cef748bf72cbbc1bf1a5291469e569ee96f73463ac7cd15d95c9c5032abc90750a253774b821914f93bd677cda788fef4728f7990cd6690702341021d2c859dcacde7a13095fb4dd3795c26e5a08d215554d4d38e1aac4b3114a163bfaacb7a3eba8820899ba230cd9aec8c2ac9856a8a18524ac01035655c16296e8a524e48937fdda52a7b82d596586216133423384eb64695b9d4986b2c318bf852ee511902c558aa6299ecb491b98cb6e7a7905484c76fc15629a6255ce9c60870bc2195ace9aac2a8c6acb2316846144e6191c242f0ef8c2b141570af371ad0020ca9f2df48944a1b64f157e77a2dac675cc93496a5821738a6f94cac91964b03ad505861ee5ee8152846ab744d1832670aeaca121953653815b559cd50715ac0d50f9a2a553fc865aea7552da8b7d05ee62cac9a8dfbeadbd59b410b640c873c6a5046a666d6e936df29580967da6e8158c48511730259dce6223656468df3090c13689b2927b9e598de01eba2d175f35ebb1ad5f619676281eadd608f5d328f66fb2d36655c45f54ef33588ef313e9020bdf62226f58f222961bccbddd6ea8eb3a27a0edaa582aff20386b691e823d51e2b1c31b8432d735961df5b5a5d64864461269011e0088b6c67b60a53252093332ee83ea37ab16a87efb163dadfd716f88ca45a9f46594648295a9f0b4bd1471ee94976bf81c3a7ee8f10b3fa88bcff1cdfe71f79b44bfff414f336e55161374242e2e2986db52d077cfffebd3a22efbb487475ab0df49543b711521093a20f5b5f0d3426e01704ba660b500d045ddb72cfdc8e6b797e21f9a3008a2eb04ddbfc607a1f4cebb36d765dbfebb9ed8ed5b1ac33ef1fa6dd35757960f947a4432ea3d708d5fd067472cf9512fa08af676c9db6404f20a830679f0bdfdfc01d5f5e42854ad672cc53dbb6ceac4e0b5ce338d9681cb3639966c7ffde027750aaf3304452beedc33b3bb53baeebf86ffab0eddac758e05af3c6341cc7ea38d69e69e8e01ef00bd206450e6bc11d5f82ae597c297df4fd6b5eea768eb3ffae575ee6069727144b5af8faf3af74f318453f7dbb2babb8bcf66c8afc6f58f7d5e9434f681ebf6ba11420f0bd0522a8601d560a05626ae365635d0cb117500ceda87d1059d65635bcb8f61a605ca7f30a592cff83e97eb0dccf96d775adaee7b4cf4ce7075499412277c38a63bf03560ed6f36158f13b8e7b6abdede33db0e278b66bdabeed9ffee8e2ccb17dff30acb8f67b81a5205ea3cb168a1c80900d5a944ba74285ea536cc34213054aeb63019605b8299a752582a0ef3f4fc6cb38b81e2513eabb834b330ee968158d493e7d88f15a8ee7b73dba5a4cec2b39e84fad80de9b70ec6783ebe1623cbe52412f994f1e87c9ed271e0f7ae7da87193dde6483feca9a8c6f16a8e77993b125bfd0d132c4b56d4a02fa6987df8b2464f7a4f2fd125ddfa4010dd31e3e8f07bd8b7cfa38b442eaaee77dc748128c579f268f372fd387863d1d65d3737e5bc73965a36ce20cd3c076e3a8efdf86b69fddf68749d4ff6db76f9abe04b6f7307dbcc8d7b67bfc86fdab3cb447a5efeb7b33a4249be6f35b9d97c1f50d89ae4779802f6434bec281136790dd2f0252c6dbb49f8ebd792f4ed7f341cb32b751df9fea5cea6f55d377e7a56eca6e16c148e76219fffe70b12cf251f2b28acf0c4c1d8fabf5355deb68487df5a0e783cffdfa1b94fcf276f689df825fc46dbdaf1e3e105646356a7b9db3ff0eb5dd3f03b5ed33cbf7cd5f41ed8e659dbaaeedfc1a6a3bbf84da5ee7ec88da7f2bd4aeabe17f08dafd2199b011bbed5b2474ee93a9fd450efaf78b800d09ba1ecea2fe150efa5f6a405c0355d0f7d9ede56f7270a8df1e7084638f0679a2a68ff72f937144ee7a17cf81ed99d3c7c47c7486c984ae48bd896c0078b598e6717ed7bb38d0afda50e25406f67d12f42e6834f69ea33e5904f8c2993cde643f17f3c777c7fc76be477948fdfce7c6fef48b634f93a87f257f6eec2fef1f9bad37b6b3cad77c3abeb1a62f56d9e6cb7203ec936c4a3b7eb90e2ad9759484d4f523fb2ad71b4d6957e6ecf771d9ae37387a654ec64bbf6a658f99ff3cb429957087fea2d7dfe39be6f14df3f8a6797cd33cbe691edf348f6f9ac737cde39be6f14df3f8a6f97f7bd3fc0f000000ffff010000ffff6d1dd2c31d290000`)))
+var _ = pkger.Apply(mem.UnmarshalEmbed([]byte(`1f8b08000000000000ffec3b6b73e2ba927fe5963f33f10b48a06a3f2499130339a1ce90090fdf3a3525cbc256902c8f2503ceadf9ef5bf20b9b802139a776efeee50ba81f6e75b75aad9654fa97828325e34aff5f8a87851f3b579051358c5fd9975795c4c0615b49fb8a23a5afa8116342a5cc8d09525aca90862c127f00e12bfde35fb79431a048e92b25fc9541a5af282de53b883c24b2f68431f1be8b2720a0aff4ffa95c297fb69467010852fa4b4038caa109029c0599088b3d6082b8640711f4f11a5d794c69290e0e4094e46db68580900c807c9d35509037965240c205a2391c0750601664100e70d620d88905263c8718708b9697352888b80ff26e326b72e6202e7a67918b22947f1902b8025eae7028adce9b2baf64897020b2e6cf1815064568d77d84c228c372e8230af2b68810c8ed11c02935118ce69ac41c452e10397fc5b2f5326f248012974109fc590c7cd5d1aa0091d22aa1371c4abfc74b2c15701281b8d25220a361843857bd8c0e5920d056a4fe87ccc581a73a80a36ebb8a817c5d057db4ad82af72f05b0a8a2216c92e96548aabc4e25d1c05e239e63e56a5bd75e2b3cf42bc4c548f7d2131a8d3965b40015ca148850e8bd4b551275310ad1c201057c39587a246a2fc95ba5344eb7c6b8a7d8089b446a5dc9331201958b8f2ae70a04aa75fad4da5a5f880fbea32909e483d8a998a991c27195d72feb5940049cb0324540a52bc6cc6916c31e9993063937faa8cf21c8ed09220283f8d9087b67258388b24cc450459da2517110e3c29842701949183a99cff718021732b2d3516cb1b3951bfa2f0e3d141c36a8c2c0910e848d0001ca04825988b5a14c12809052b1b2ac8e4a65815e2d047d10e76ab4497831d80a0ebd7a01ad1353a1dbd574110824381e10eb3c421d7dbda0ee1afdc6505a2a0c2ec872bb4837020501400a23a4cbafc2841751cdc40e5078990055c8040e4a3b74f4681885898a86bfd4abbd20e30bcb36b9f5277f821aaea41dac441306892e0608f32b78101fa08ae1ae86ee4780de4fac81f2273d044df8f8d031c1b10b9fc236cea1223d264733dbade936be1f68e4c49b34d94ac50d39005980bd4d441c6a02e31100d5c51a312dc0746a7dbcc6036933bbad1c4103b82a006064178a300496fd00002e837887751c855b94aa625c1093e18c627383ce622276e08f494eb481ac859e48a739cca02921ca0621a9203e80804870258a2f3356c9fc4135eff88ba9d0a508fd9bd10ad7f18c1f6eec35a94711fe835a81662f588da0fa0fd7811a492b604e1ef1c5663d876b4caec97901aae70b5aea9963880077a159625926934174d59c5fbf132aa0a97361c25a4d092008f37b3b0509ce0d8e008bde378e5e5ca5e27ac6bd68788feaf54801e73e2e51210a6fa284275da87aac3d2131484fc4c5601568805ea41561f85e06f12232b4581a2135a65e5ed393c2aa20e723f572c1fe1e3c265fcacb2ba91419595ec9e9c6dbb7da32e090342ef1eafcbf33f1546d034f66af5c2cfc0c1359083a00a3b986735f80e93080488b78f2ad68712097d007d7093e7bc1d9aad51043ca44602b29a26d9ea5182c54e8060816a782af26d4089f298dcddd531c53ab38fe2751cda8628c214057b02598d8fee792540424400d6f4623cddea55512123a406474c5a1521c8a29a53f665e55b9f7dd3a338904ba30a04a3181ea2402f6271788882b658f88cad0ed1bc83b23ca872088243a43c1d1cc00bff103e0c23b6540970103944e6c941693ce1f24044253888b755060e9628c2ac86c28147d09260cfaf8de46eab5845c93de3be73f30d640d1688d7a5e51aa12d8228581f22c501aee92a4510568bc43474b2dfb55125c481b4cc47209f4af97e7ac9f7f6d558a4f44c2c615e9935d33d77c8775b6f2af7d4d9862c6f8a825ad43e653b5b4668567bc93f95c644e010a4932d45fc8c99406e7ada234f6b6a7b7b5f8830dfdbcb66fa534c92125951f41d4e051c627c902221e32805324a597094cc97ebf7c70f0112b85057aee461c4047b7f34c1783ad629a8cab3a80f1d57640d194902c8a0c8037bd752617a84c50986889f75be21ff76f33f0fba13e71e7ab70edf64e0cf38e39331270fd450e0b248f518018177c5224fddaa791d98a572433b8f2b6424d14dad73823b152d7716e7f215e566037339eec576fd1cde13facac07103aeba01a78873e01d53b88c3ef9e3c5829fc317466c9b9c6034543f2f148e7161370047c83c29f66587a832f4558e601c21d5c12e8eb2e3f3a3ac2202015fb288363115a126059ec31764f23608ace409dd77c445795e2ecfa4335479b29ba19ed2936b790170fa94ff09e040e98b2846adc3d705167b62ee1e5af5d85576a463b1298a384ecff2f52bdd547efdfa959fc7375d4ef4a50292415e63c87f170980497aa11194f70e724ee337a4f4db5aafdb52a89cbd7d436f5fb76fda7ae73ac5fc90b942e92b8666685fb4ce17adfb5deff6f56edfbcb6e5d2c07fb8d2aacc40b998ca6b11b456fadd8e66b45bca30604a5fd7f5b6de315bca98e060a5f48dd48748e9ebdd9b9ed9525eb0abf4b59662e5fff31f3f42e06a697be24a695a4b79aea87a475655cdef08832baef46f5acaadc0545af98ca0d2d7af7b86796368fa754b197389e91abad1edde743abf5aca538db57373737da35ff74a56ed574bb96f96d6e9ea5dd3307bc6af9632fff1230e628e5ca5ff4fada5b5b43fd3a192a7abff0e374547c5ef2e90b231acdf1f393126ee3f865fff4131a7a9accb85d2fffc85529676b2eb835d56fa774f5479b922d3e4ca3b2bc22542f9d552e4ad5b61430822b9432aa5ecb8d32e8e094d33a02a055d9d4c852557910f4d43ef15f9b06d76f71361f78bae7dd17bdfb576bfd3e99bddab9ed6d5f54edbe85653627e1fdb9c13db654ed48b9c689a86d6fe504eccd4fd504eec5c9bbd228be95dbd7d73a35db7dfe5c482b55bb096861ece8dc7583f9a1be5d8ede7c7ddb867c4a624b84b7c590c9d7b439e71ff474ebbdd5429e79fe258bdd7c56ce33983a9bfa0bdf6f0abe6413addba3392d8cf1e2ef178f5784fb7eb85f1c08796ad3b74ac81592f1e0e26ebd9ec4138f7fe6a319ff8bfdfdfade160f2f6f88d79c3fb5b294b73e7a378686df5c56cb446f79dce62a6f3173add40e286aee531c7bcd360b2f16ceb415b3caf1eed596775ef85dc31c6be737f47dd59e7d5b5c8dac1779bc57cf4664f89efcc360c9a9304cc3ac1d97d5a0f09345e0e7c1712877e6bb6efb7072e6d748cf1db5fb1d1b51eb063bdc4eeacb359ccc6d1a335592fcca7b059873b1f066352d1e3cd1d8c4287423eb47a1b77f014dee35b6f787f97d8f3890e69bb1ccfdf03e9abedb7d46f2f47bea5d3d8be658f452cd8c1345e9893d031da1e4afb943a4e853deb688f83b1062989ed64f5286d1f0e46c41d4c1307df7177f6801dd38b9bbe69185bcdd1c237c768b32c0e365ee6b3e3fd8060bc76c888c0c1f0dd372763e825ebeb0331f4131abdf8533164c9be3acff66cbc8674f2f668d9a163bd9c1e3b7ae2bb8671cb7ce326603e2110fb14ccb6e45c1ba7e62874ad69f291fe5cabf7e2183a7fb426be6bfdd6108f93b533db3edbf3bba4e46d900b537f4f33d967c49e6bf584f390cd97f3e36efce6623f714cf79cb9fd0a4d3bd37f305abbe6d359fec9edf80acdc547624ef695cddde78fcddb8539365e68cf84c9d9632ffb7a963ef8e8b8a736a57d9d9eb3ee40ea35ddc077fe3e9dffa683b1b11bd333fbfa64ce7f9e75c293b14c490ca6d5fc734ede2131d88de509d91f8d63fdcd36effc85c14b7d8ef9c6998f03683dbc02fda3faeffaf8401c0b68b8e97af7a9fc3998acbf19a335c4598dd114c30bda4bf2f8ca799be466fecd65bf9f5f47c7668c1d73f4b979391f258bf98ae57540431f0f09a40f9dc7c1c45fd02d69b4c3ea6140a7afeebdaf2d66236e378dbb31fa69cfc6da79720541f3a73374dde36bca17f48183999c572fcca50fdc9dbdf0e160fc0aaca9688ad753df35c4edd69d4d13f4ec1b8bd956b79f379e3df737101fef0bcea70406ab5d3fd6b40d07c346bb9cd934b18d1726eb96053e9d9b8ef137d821ecf928b0a777be6b8dd9e3c0f69dc154aee99bc57cf20aee4ff535fd96f1edfc00658e30bc46bb6c8b501bfbb2aec70df36e0566367db47ee343abd94f799f15dff6364d7e3ac69ffba98c45b4c97473ad9e2d6b6fb98f29dabfdf66343b18ad9d6cefe0fdf19ce7b30ce6796c6b8e2ee1ed9d63a53c55b8e0a190f6c4ae16bfedbdafcf37b93da9acdf1c63ac3bb369ecdedff6dee30adec9fa59d66cf8b6b76be734cb4e1c437f94b599b42baf2552b8b0ada88517462fb1074f52f7ac5ea5d357c71cad6052c84a6bca39a444b3e7c392afa8f90a79453d97fb31adbf0a5ae6c7c9baeec7c9bae6c7b4a6ca6cf9668e8ddab72f052dcfbf15faae6eb9ed0dadf19b4bb21aab94ab4f4ab9d3c1eebb5ca79adc2addb57a2387aea4bd9aa3c935b8e6db825659a373fa60b2fe5eac95c96daf0ed7648c8b35ae324625aea2c757b946e57e4ddb7bbec18e39ace822d79a6161bf0f83918f9ea56fb2f5a1f8b6c8eb526ed12e68c09876327fa679ba9025f34028d77d5bca93f9c42272cd24c577791e94bae439b4b0572790ba24ed2bcb6385cc5a8edad18bdc537c3f096dba9072d3bc51f697cdf5dcf62a7f47cfe7e32ea705d3749e2dbfb147e52f9e20caa3e6d37729ccab9d1f766eae1b8e0f9bee51ce3a34ecfc1d8786a98e9fbe47e9f534fdbaab19d77fd73d4aa76bb43be6e5acf0ffc4596111ef7fe351a135218b601a3c5a3a81e6d8b70db99c8fd74e3021683059ee9599bba96ef582c7afb2b438f15d43d901661dea24beb0e7e3b7c5cc9565d3ab6374347bee6b73b32885f3549adbf13bddaeedc44b7ebfbf3bf15d5e421f2edbccc57c147fcee6a7b36d3eecef6902692ff95cdfdffe62dfb6ef5a0ffc737dbf9cdf7750968cd7b9ac953d1be9f69b9efd974b34896d7ad3cbe220c70d5c1fd276cf351e925da995f9ec8f59f65f2c4d367dd016b34d2fffe7f781f65fa7969decf6031d4e69fbe9ecf4ac2ce1a64cb7d7c5e511e1e511e1e511e1e511e1e511e1e511e1e511e1e511e1e511e1e511e1e511e1e511e1e511e1e511e1e511e1e511e1e511e1e511e1e511e1e511e1e511e1e511e1e511e1ffb74784ff0d0000ffff03008a8b49bfe2500000`)))
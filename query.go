@@ -0,0 +1,811 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"fmt"
+	"github.com/Shopify/go-lua"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxQueryDepth bounds the nesting of parentheses, filters and functions in a query
+const maxQueryDepth = 200
+
+// queryFunc produces the results of a query stage applied to the input v, root being the queried document
+type queryFunc func(root, v interface{}) ([]interface{}, error)
+
+// Query is a compiled path query. It accepts JSONPath expressions like "$.items[*].name",
+// "$..price" or "$.items[?(@.qty > 1 && @.tag =~ '^a')]" and a jq-like subset with
+// pipes, ".a.b", ".[]", map(f), select(f), keys, length and not.
+// Array indexes are 0-based as in JSONPath and jq, negative indexes counting from the end,
+// and slices like [1:3] select from start included to end excluded.
+type Query struct {
+	expr string
+	f    queryFunc
+}
+
+// Run applies the query to a value pulled from Lua or decoded from JSON, returning all its results
+func (q *Query) Run(v interface{}) ([]interface{}, error) {
+	return q.f(v, v)
+}
+
+func (q *Query) String() string {
+	return q.expr
+}
+
+type queryToken struct {
+	kind string // ident, number, string, op or eof
+	text string
+	num  float64
+	pos  int
+}
+
+var queryOps = []string{"..", "==", "!=", "<=", ">=", "&&", "||", "=~", "$", "@", ".", "[", "]", "(", ")", ",", "*", "?", "|", "<", ">", "!", "-", ":"}
+
+func lexQuery(expr string) ([]queryToken, error) {
+	tokens := make([]queryToken, 0)
+	i := 0
+	for i < len(expr) {
+		r, size := utf8.DecodeRuneInString(expr[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '_' || unicode.IsLetter(r):
+			start := i
+			for i < len(expr) {
+				r, size = utf8.DecodeRuneInString(expr[i:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				i += size
+			}
+			tokens = append(tokens, queryToken{kind: "ident", text: expr[start:i], pos: start})
+		case r >= '0' && r <= '9':
+			start := i
+			for i < len(expr) && (expr[i] >= '0' && expr[i] <= '9' || expr[i] == '.' || expr[i] == 'e' || expr[i] == 'E') {
+				i++
+			}
+			n, err := strconv.ParseFloat(expr[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("query: invalid number %q at offset %d", expr[start:i], start)
+			}
+			tokens = append(tokens, queryToken{kind: "number", text: expr[start:i], num: n, pos: start})
+		case r == '\'' || r == '"':
+			start := i
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(expr) {
+					return nil, fmt.Errorf("query: unterminated string at offset %d", start)
+				}
+				c := expr[i]
+				if c == byte(r) {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(expr) {
+					i++
+					switch expr[i] {
+					case 'n':
+						c = '\n'
+					case 't':
+						c = '\t'
+					default:
+						c = expr[i]
+					}
+				}
+				sb.WriteByte(c)
+				i++
+			}
+			tokens = append(tokens, queryToken{kind: "string", text: sb.String(), pos: start})
+		default:
+			matched := false
+			for _, op := range queryOps {
+				if strings.HasPrefix(expr[i:], op) {
+					tokens = append(tokens, queryToken{kind: "op", text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("query: unexpected %q at offset %d", r, i)
+			}
+		}
+	}
+	return append(tokens, queryToken{kind: "eof", pos: len(expr)}), nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	i      int
+	depth  int
+}
+
+// ParseQuery compiles a JSONPath or jq-like query expression
+func ParseQuery(expr string) (*Query, error) {
+	tokens, err := lexQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	f, err := p.pipeline()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "eof" {
+		return nil, p.unexpected(t)
+	}
+	return &Query{expr: expr, f: f}, nil
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.i]
+}
+
+func (p *queryParser) next() queryToken {
+	t := p.tokens[p.i]
+	if t.kind != "eof" {
+		p.i++
+	}
+	return t
+}
+
+// accept consumes the next token when it is the given operator or keyword
+func (p *queryParser) accept(text string) bool {
+	t := p.peek()
+	if (t.kind == "op" || t.kind == "ident") && t.text == text {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected(p.peek())
+	}
+	return nil
+}
+
+func (p *queryParser) unexpected(t queryToken) error {
+	if t.kind == "eof" {
+		return fmt.Errorf("query: unexpected end of expression")
+	}
+	text := t.text
+	if t.kind == "string" {
+		text = strconv.Quote(text)
+	}
+	return fmt.Errorf("query: unexpected %s at offset %d", text, t.pos)
+}
+
+func (p *queryParser) pipeline() (queryFunc, error) {
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("|") {
+		g, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		f = pipeQuery(f, g)
+	}
+	return f, nil
+}
+
+func (p *queryParser) or() (queryFunc, error) {
+	f, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") || p.accept("or") {
+		g, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left := f
+		f = func(root, v interface{}) ([]interface{}, error) {
+			a, err := truthyQuery(left, root, v)
+			if err != nil || a {
+				return []interface{}{a}, err
+			}
+			b, err := truthyQuery(g, root, v)
+			return []interface{}{b}, err
+		}
+	}
+	return f, nil
+}
+
+func (p *queryParser) and() (queryFunc, error) {
+	f, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") || p.accept("and") {
+		g, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left := f
+		f = func(root, v interface{}) ([]interface{}, error) {
+			a, err := truthyQuery(left, root, v)
+			if err != nil || !a {
+				return []interface{}{a}, err
+			}
+			b, err := truthyQuery(g, root, v)
+			return []interface{}{b}, err
+		}
+	}
+	return f, nil
+}
+
+func (p *queryParser) unary() (queryFunc, error) {
+	if p.depth >= maxQueryDepth {
+		return nil, fmt.Errorf("query: too deeply nested at offset %d", p.peek().pos)
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.accept("!") {
+		f, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(root, v interface{}) ([]interface{}, error) {
+			b, err := truthyQuery(f, root, v)
+			return []interface{}{!b}, err
+		}, nil
+	}
+	return p.comparison()
+}
+
+func (p *queryParser) comparison() (queryFunc, error) {
+	left, err := p.postfix()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t.kind != "op" {
+		return left, nil
+	}
+	switch t.text {
+	case "=~":
+		p.next()
+		pattern := p.next()
+		if pattern.kind != "string" {
+			return nil, p.unexpected(pattern)
+		}
+		re, err := regexp.Compile(pattern.text)
+		if err != nil {
+			return nil, fmt.Errorf("query: %v", err)
+		}
+		return func(root, v interface{}) ([]interface{}, error) {
+			a, err := left(root, v)
+			if err != nil {
+				return nil, err
+			}
+			s, ok := stringOf(firstResult(a))
+			return []interface{}{ok && re.MatchString(s)}, nil
+		}, nil
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+		right, err := p.postfix()
+		if err != nil {
+			return nil, err
+		}
+		return func(root, v interface{}) ([]interface{}, error) {
+			a, err := left(root, v)
+			if err != nil {
+				return nil, err
+			}
+			b, err := right(root, v)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{compareQuery(t.text, firstResult(a), firstResult(b))}, nil
+		}, nil
+	}
+	return left, nil
+}
+
+func (p *queryParser) postfix() (queryFunc, error) {
+	f, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != "op" {
+			return f, nil
+		}
+		var sel queryFunc
+		switch t.text {
+		case ".":
+			p.next()
+			if p.peek().kind == "op" && p.peek().text == "[" {
+				continue
+			}
+			sel, err = p.name()
+		case "..":
+			p.next()
+			if p.peek().kind == "op" && p.peek().text == "[" {
+				p.next()
+				sel, err = p.bracket()
+			} else {
+				sel, err = p.name()
+			}
+			if err == nil {
+				sel = descendantQuery(sel)
+			}
+		case "[":
+			p.next()
+			sel, err = p.bracket()
+		default:
+			return f, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		f = pipeQuery(f, sel)
+	}
+}
+
+// name parses the member name or wildcard following a dot
+func (p *queryParser) name() (queryFunc, error) {
+	t := p.next()
+	switch {
+	case t.kind == "ident" || t.kind == "string":
+		name := t.text
+		return func(root, v interface{}) ([]interface{}, error) {
+			if e, ok := queryMember(v, name); ok {
+				return []interface{}{e}, nil
+			}
+			return nil, nil
+		}, nil
+	case t.kind == "op" && t.text == "*":
+		return childrenQuery, nil
+	}
+	return nil, p.unexpected(t)
+}
+
+// bracket parses the selectors following an opening bracket: [], [*], [?filter] or a union of indexes, slices and names
+func (p *queryParser) bracket() (queryFunc, error) {
+	if p.accept("]") {
+		return childrenQuery, nil
+	}
+	if p.accept("*") {
+		return childrenQuery, p.expect("]")
+	}
+	if p.accept("?") {
+		cond, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return func(root, v interface{}) ([]interface{}, error) {
+			res := make([]interface{}, 0)
+			for _, e := range queryChildren(v) {
+				ok, err := truthyQuery(cond, root, e)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					res = append(res, e)
+				}
+			}
+			return res, nil
+		}, p.expect("]")
+	}
+	selectors := make([]interface{}, 0)
+	for {
+		if t := p.peek(); t.kind == "string" {
+			p.next()
+			selectors = append(selectors, t.text)
+		} else {
+			start, hasStart, err := p.index()
+			if err != nil {
+				return nil, err
+			}
+			if p.accept(":") {
+				end, hasEnd, err := p.index()
+				if err != nil {
+					return nil, err
+				}
+				selectors = append(selectors, querySlice{start: start, end: end, hasStart: hasStart, hasEnd: hasEnd})
+			} else if hasStart {
+				selectors = append(selectors, start)
+			} else {
+				return nil, p.unexpected(p.peek())
+			}
+		}
+		if !p.accept(",") {
+			break
+		}
+	}
+	return func(root, v interface{}) ([]interface{}, error) {
+		res := make([]interface{}, 0)
+		a, isArray := arrayOf(v)
+		for _, s := range selectors {
+			switch s := s.(type) {
+			case string:
+				if e, ok := queryMember(v, s); ok {
+					res = append(res, e)
+				}
+			case int:
+				i := s
+				if i < 0 {
+					i += len(a)
+				}
+				if isArray && i >= 0 && i < len(a) {
+					res = append(res, a[i])
+				}
+			case querySlice:
+				if isArray {
+					start, end := s.bounds(len(a))
+					res = append(res, a[start:end]...)
+				}
+			}
+		}
+		return res, nil
+	}, p.expect("]")
+}
+
+// querySlice is a [start:end] selector, end excluded and negative bounds counting from the end
+type querySlice struct {
+	start, end       int
+	hasStart, hasEnd bool
+}
+
+func (s querySlice) bounds(length int) (int, int) {
+	clamp := func(i int, given bool, def int) int {
+		if !given {
+			return def
+		}
+		if i < 0 {
+			i += length
+		}
+		if i < 0 {
+			return 0
+		}
+		if i > length {
+			return length
+		}
+		return i
+	}
+	start, end := clamp(s.start, s.hasStart, 0), clamp(s.end, s.hasEnd, length)
+	if end < start {
+		end = start
+	}
+	return start, end
+}
+
+// index parses an optional, possibly negative, integer
+func (p *queryParser) index() (int, bool, error) {
+	negative := p.accept("-")
+	t := p.peek()
+	if t.kind != "number" {
+		if negative {
+			return 0, false, p.unexpected(t)
+		}
+		return 0, false, nil
+	}
+	p.next()
+	if t.num != float64(int(t.num)) {
+		return 0, false, fmt.Errorf("query: invalid index %s at offset %d", t.text, t.pos)
+	}
+	if negative {
+		return -int(t.num), true, nil
+	}
+	return int(t.num), true, nil
+}
+
+func (p *queryParser) primary() (queryFunc, error) {
+	t := p.next()
+	switch t.kind {
+	case "number":
+		return constQuery(t.num), nil
+	case "string":
+		return constQuery(t.text), nil
+	case "ident":
+		return p.function(t)
+	case "op":
+		switch t.text {
+		case "$":
+			return func(root, v interface{}) ([]interface{}, error) {
+				return []interface{}{root}, nil
+			}, nil
+		case "@":
+			return identityQuery, nil
+		case ".", "..":
+			// a leading dot is the input itself, followed by a member when one is given
+			next := p.peek()
+			if next.kind == "ident" || next.kind == "string" || next.kind == "op" && (next.text == "*" || next.text == "[") || t.text == ".." {
+				p.i--
+			}
+			return identityQuery, nil
+		case "-":
+			if n := p.next(); n.kind == "number" {
+				return constQuery(-n.num), nil
+			}
+		case "(":
+			f, err := p.pipeline()
+			if err != nil {
+				return nil, err
+			}
+			return f, p.expect(")")
+		}
+	}
+	return nil, p.unexpected(t)
+}
+
+func (p *queryParser) function(t queryToken) (queryFunc, error) {
+	switch t.text {
+	case "true":
+		return constQuery(true), nil
+	case "false":
+		return constQuery(false), nil
+	case "null":
+		return constQuery(nil), nil
+	case "not":
+		return func(root, v interface{}) ([]interface{}, error) {
+			return []interface{}{!truthy(v)}, nil
+		}, nil
+	case "keys":
+		return keysQuery, nil
+	case "length":
+		return lengthQuery, nil
+	case "map", "select":
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		f, err := p.pipeline()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		if t.text == "select" {
+			return func(root, v interface{}) ([]interface{}, error) {
+				ok, err := truthyQuery(f, root, v)
+				if err != nil || !ok {
+					return nil, err
+				}
+				return []interface{}{v}, nil
+			}, nil
+		}
+		return func(root, v interface{}) ([]interface{}, error) {
+			a, ok := arrayOf(v)
+			if !ok {
+				return nil, fmt.Errorf("query: cannot map over %s", jsonType(v))
+			}
+			res := make([]interface{}, 0, len(a))
+			for _, e := range a {
+				out, err := f(root, e)
+				if err != nil {
+					return nil, err
+				}
+				res = append(res, out...)
+			}
+			return []interface{}{res}, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("query: unknown function %s at offset %d", t.text, t.pos)
+}
+
+func identityQuery(root, v interface{}) ([]interface{}, error) {
+	return []interface{}{v}, nil
+}
+
+func childrenQuery(root, v interface{}) ([]interface{}, error) {
+	return queryChildren(v), nil
+}
+
+func constQuery(c interface{}) queryFunc {
+	return func(root, v interface{}) ([]interface{}, error) {
+		return []interface{}{c}, nil
+	}
+}
+
+// pipeQuery feeds every result of f to g
+func pipeQuery(f, g queryFunc) queryFunc {
+	return func(root, v interface{}) ([]interface{}, error) {
+		in, err := f(root, v)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]interface{}, 0, len(in))
+		for _, e := range in {
+			out, err := g(root, e)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, out...)
+		}
+		return res, nil
+	}
+}
+
+// descendantQuery applies sel to v and all its descendants, depth first
+func descendantQuery(sel queryFunc) queryFunc {
+	return func(root, v interface{}) ([]interface{}, error) {
+		res := make([]interface{}, 0)
+		var walk func(e interface{}) error
+		walk = func(e interface{}) error {
+			out, err := sel(root, e)
+			if err != nil {
+				return err
+			}
+			res = append(res, out...)
+			for _, c := range queryChildren(e) {
+				if err := walk(c); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return res, walk(v)
+	}
+}
+
+func keysQuery(root, v interface{}) ([]interface{}, error) {
+	if a, ok := v.([]interface{}); ok {
+		keys := make([]interface{}, len(a))
+		for i := range a {
+			keys[i] = int64(i)
+		}
+		return []interface{}{keys}, nil
+	}
+	items, ok := mapItems(v)
+	if !ok {
+		return nil, fmt.Errorf("query: %s has no keys", jsonType(v))
+	}
+	keys := make([]interface{}, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	return []interface{}{keys}, nil
+}
+
+func lengthQuery(root, v interface{}) ([]interface{}, error) {
+	if v == nil {
+		return []interface{}{int64(0)}, nil
+	}
+	if s, ok := stringOf(v); ok {
+		return []interface{}{int64(utf8.RuneCountInString(s))}, nil
+	}
+	if a, ok := v.([]interface{}); ok {
+		return []interface{}{int64(len(a))}, nil
+	}
+	if items, ok := mapItems(v); ok {
+		return []interface{}{int64(len(items))}, nil
+	}
+	return nil, fmt.Errorf("query: %s has no length", jsonType(v))
+}
+
+// queryMember returns the named member of an object
+func queryMember(v interface{}, name string) (interface{}, bool) {
+	if m, ok := v.(map[string]interface{}); ok {
+		e, ok := m[name]
+		return e, ok
+	}
+	items, _ := mapItems(v)
+	for _, item := range items {
+		if fmt.Sprint(item.Key) == name {
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
+
+// queryChildren returns the elements of an array or the values of an object, in key order
+func queryChildren(v interface{}) []interface{} {
+	if a, ok := v.([]interface{}); ok {
+		return a
+	}
+	items, _ := mapItems(v)
+	res := make([]interface{}, len(items))
+	for i, item := range items {
+		res[i] = item.Value
+	}
+	return res
+}
+
+func firstResult(res []interface{}) interface{} {
+	if len(res) == 0 {
+		return nil
+	}
+	return res[0]
+}
+
+func truthy(v interface{}) bool {
+	return v != nil && v != false
+}
+
+// truthyQuery tells whether the first result of f exists and is neither null nor false
+func truthyQuery(f queryFunc, root, v interface{}) (bool, error) {
+	res, err := f(root, v)
+	return len(res) > 0 && truthy(res[0]), err
+}
+
+// compareQuery compares numbers by value and strings lexically, missing values being null
+func compareQuery(op string, a, b interface{}) bool {
+	switch op {
+	case "==":
+		return jsonEqual(a, b)
+	case "!=":
+		return !jsonEqual(a, b)
+	}
+	var c int
+	if x, ok := numberOf(a); ok {
+		y, ok := numberOf(b)
+		if !ok {
+			return false
+		}
+		switch {
+		case x < y:
+			c = -1
+		case x > y:
+			c = 1
+		}
+	} else if x, ok := stringOf(a); ok {
+		y, ok := stringOf(b)
+		if !ok {
+			return false
+		}
+		c = strings.Compare(x, y)
+	} else {
+		return false
+	}
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+// RunQuery applies the query given as second argument to its first argument, returning an array of all the results
+func RunQuery(l *lua.State) int {
+	q, err := ParseQuery(lua.CheckString(l, 2))
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	v, err := newPuller(l, encoderPullOptions(l)).value(1, "$")
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	res, err := q.Run(v)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	DeepPushWith(l, res, PushOptions{Nulls: true})
+	return 1
+}
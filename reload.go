@@ -0,0 +1,208 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"context"
+	"errors"
+	"github.com/Shopify/go-lua"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Reloader re-executes the modules of package.loaded whose file changed on the environment filesystem.
+// A lua.State is not safe for concurrent use: Check and Watch must run on the goroutine owning the state.
+type Reloader struct {
+	l     *lua.State
+	env   *Environment
+	etags map[string]string
+}
+
+// NewReloader records the file ETag of every module already loaded by a state of an Environment.
+// Changes are detected by polling, with Check or Watch: a changed module is run again and its previous table
+// is patched in place, after the new module __reload(old) function, if any, carried over its state.
+func NewReloader(l *lua.State) (*Reloader, error) {
+	env, err := GetEnvironment(l)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reloader{l: l, env: env, etags: make(map[string]string)}
+	for _, name := range r.loadedModules() {
+		file, ok := r.moduleFile(name)
+		if !ok {
+			continue
+		}
+		if etag, err := fileETag(r.env.Fs, file); err == nil {
+			r.etags[name] = etag
+		}
+	}
+	return r, nil
+}
+
+// Check reloads the modules changed since the previous check and returns their names.
+// Modules loaded since the previous check are only recorded.
+// Reload errors are reported through Environment.Log, the previous module stays in use.
+func (r *Reloader) Check() []string {
+	reloaded := make([]string, 0)
+	for _, name := range r.loadedModules() {
+		file, ok := r.moduleFile(name)
+		if !ok {
+			continue
+		}
+		etag, err := fileETag(r.env.Fs, file)
+		if err != nil {
+			r.env.Log.Warn("checking module", map[string]interface{}{"module": name, "file": file, "error": err.Error()})
+			continue
+		}
+		previous, known := r.etags[name]
+		r.etags[name] = etag
+		if !known || previous == etag {
+			continue
+		}
+		if err := r.reload(name, file); err != nil {
+			r.env.Log.Error("reloading module", map[string]interface{}{"module": name, "file": file, "error": err.Error()})
+			continue
+		}
+		r.env.Log.Info("reloaded module", map[string]interface{}{"module": name, "file": file})
+		reloaded = append(reloaded, name)
+	}
+	return reloaded
+}
+
+// Watch calls Check every interval until the context is done
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			r.Check()
+		}
+	}
+}
+
+func (r *Reloader) loadedModules() []string {
+	l := r.l
+	names := make([]string, 0)
+	l.Field(lua.RegistryIndex, "_LOADED")
+	l.PushNil()
+	for l.Next(-2) {
+		if l.TypeOf(-2) == lua.TypeString {
+			name, _ := l.ToString(-2)
+			names = append(names, name)
+		}
+		l.Pop(1)
+	}
+	l.Pop(1)
+	sort.Strings(names)
+	return names
+}
+
+// moduleFile resolves the file a module was loaded from, ignoring modules served by LuaLibs
+func (r *Reloader) moduleFile(name string) (string, bool) {
+	if _, ok := r.env.LuaLibs[name]; ok {
+		return "", false
+	}
+	l := r.l
+	l.Field(lua.RegistryIndex, "_LOADED")
+	l.Field(-1, "package")
+	if !l.IsTable(-1) {
+		l.Pop(2)
+		return "", false
+	}
+	l.Field(-1, "path")
+	p, ok := l.ToString(-1)
+	l.Pop(3)
+	if !ok {
+		return "", false
+	}
+	file, err := searchPath(l, name, p, ".", string(filepath.Separator))
+	if err != nil {
+		return "", false
+	}
+	return file, true
+}
+
+func (r *Reloader) reload(name, file string) error {
+	l := r.l
+	top := l.Top()
+	defer l.SetTop(top)
+	if err := LoadFile(l, file, ""); err != nil {
+		msg, _ := l.ToString(-1)
+		return errors.New(msg)
+	}
+	l.PushString(name)
+	l.PushString(file)
+	if err := l.ProtectedCall(2, 1, 0); err != nil {
+		msg, _ := l.ToString(-1)
+		return errors.New(msg)
+	}
+	module := l.Top()
+	l.Field(lua.RegistryIndex, "_LOADED")
+	loaded := l.Top()
+	l.Field(loaded, name)
+	old := l.Top()
+	if l.IsNil(module) {
+		return nil
+	}
+	if !l.IsTable(module) || !l.IsTable(old) {
+		l.PushValue(module)
+		l.SetField(loaded, name)
+		return nil
+	}
+	// let the new module carry over state from the previous one
+	l.Field(module, "__reload")
+	if l.IsFunction(-1) {
+		l.PushValue(old)
+		if err := l.ProtectedCall(1, 0, 0); err != nil {
+			msg, _ := l.ToString(-1)
+			return errors.New("__reload: " + msg)
+		}
+	} else {
+		l.Pop(1)
+	}
+	// patch the previous table in place so that existing references see the new code
+	l.NewTable()
+	stale := l.Top()
+	l.PushNil()
+	for l.Next(old) {
+		l.Pop(1)
+		l.PushValue(-1)
+		l.RawGet(module)
+		if l.IsNil(-1) {
+			l.PushValue(-2)
+			l.RawSetInt(stale, l.RawLength(stale)+1)
+		}
+		l.Pop(1)
+	}
+	for i := 1; i <= l.RawLength(stale); i++ {
+		l.RawGetInt(stale, i)
+		l.PushNil()
+		l.RawSet(old)
+	}
+	l.PushNil()
+	for l.Next(module) {
+		l.PushValue(-2)
+		l.Insert(-2)
+		l.RawSet(old)
+	}
+	return nil
+}
@@ -19,87 +19,355 @@ package luabox
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"github.com/Shopify/go-lua"
 	"gopkg.in/yaml.v3"
+	"io"
+	"math"
+	"strings"
+	"unicode/utf8"
 )
 
-func Repr(l *lua.State) int {
-	args, err := PullVarargs(l, 1)
+// encoderPullOptions are the environment conversion options, honoring recorded key orders
+func encoderPullOptions(l *lua.State) PullOptions {
+	opts := environmentPullOptions(l)
+	opts.Ordered = true
+	return opts
+}
+
+// EncodeOptions tunes the JSON and YAML encoders
+type EncodeOptions struct {
+	// Indent is the JSON indentation, compact when empty
+	Indent string
+	// YamlIndent is the YAML indentation width, 4 when 0
+	YamlIndent int
+	// SortKeys sorts object keys, ignoring recorded key orders
+	SortKeys bool
+	// EscapeHTML escapes <, > and & in JSON strings
+	EscapeHTML bool
+	// Flow writes YAML collections in flow style
+	Flow bool
+	// Canonical produces a stable output for hashing: sorted keys, compact JSON without HTML escaping
+	Canonical bool
+}
+
+// maxIndent bounds the indentation width of the encoders
+const maxIndent = 16
+
+// encodeOptions reads the options table of the encoders at idx:
+// indent (number of spaces or string), sortKeys, escapeHTML (true by default), flow and canonical
+func encodeOptions(l *lua.State, idx int) EncodeOptions {
+	opts := EncodeOptions{EscapeHTML: true}
+	if !l.IsTable(idx) {
+		return opts
+	}
+	l.Field(idx, "indent")
+	switch l.TypeOf(-1) {
+	case lua.TypeNumber:
+		n, _ := l.ToInteger(-1)
+		if n < 0 || n > maxIndent {
+			lua.ArgumentError(l, idx, fmt.Sprintf("indent must be between 0 and %d", maxIndent))
+		}
+		opts.Indent = strings.Repeat(" ", n)
+		opts.YamlIndent = n
+	case lua.TypeString:
+		opts.Indent, _ = l.ToString(-1)
+		if len(opts.Indent) > maxIndent || strings.Trim(opts.Indent, " \t") != "" {
+			lua.ArgumentError(l, idx, fmt.Sprintf("indent must be at most %d spaces or tabs", maxIndent))
+		}
+		opts.YamlIndent = len(opts.Indent)
+	}
+	l.Pop(1)
+	l.Field(idx, "escapeHTML")
+	if !l.IsNil(-1) {
+		opts.EscapeHTML = l.ToBoolean(-1)
+	}
+	l.Pop(1)
+	opts.SortKeys = optionFlag(l, idx, "sortKeys")
+	opts.Flow = optionFlag(l, idx, "flow")
+	opts.Canonical = optionFlag(l, idx, "canonical")
+	if opts.Canonical {
+		opts.SortKeys = true
+		opts.Indent = ""
+		opts.EscapeHTML = false
+	}
+	return opts
+}
+
+// pullOptions are the conversion options of the values to encode
+func (o EncodeOptions) pullOptions(l *lua.State) PullOptions {
+	opts := encoderPullOptions(l)
+	opts.Ordered = !o.SortKeys
+	return opts
+}
+
+// EncodeJSON encodes a value pulled from Lua to JSON
+func EncodeJSON(v interface{}, opts EncodeOptions) (string, error) {
+	if err := checkJSON(v, "$"); err != nil {
+		return "", err
+	}
+	b := &bytes.Buffer{}
+	encoder := json.NewEncoder(b)
+	encoder.SetEscapeHTML(opts.EscapeHTML)
+	encoder.SetIndent("", opts.Indent)
+	if err := encoder.Encode(stringKeys(v)); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// EncodeYAML encodes values pulled from Lua as a YAML stream, one document per value
+func EncodeYAML(docs []interface{}, opts EncodeOptions) (string, error) {
+	b := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(b)
+	if opts.YamlIndent > 0 {
+		encoder.SetIndent(opts.YamlIndent)
+	}
+	for _, doc := range docs {
+		var v interface{} = yamlBinary(doc)
+		if opts.Flow {
+			n, err := yamlNode(v)
+			if err != nil {
+				return "", err
+			}
+			setFlowStyle(n)
+			v = n
+		}
+		if err := encoder.Encode(v); err != nil {
+			return "", err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func setFlowStyle(n *yaml.Node) {
+	if n.Kind == yaml.MappingNode || n.Kind == yaml.SequenceNode {
+		n.Style |= yaml.FlowStyle
+	}
+	for _, c := range n.Content {
+		setFlowStyle(c)
+	}
+}
+
+func reprYaml(l *lua.State, first int, opts EncodeOptions) int {
+	args, err := pullVarargsWith(l, first, opts.pullOptions(l))
 	if err != nil {
 		l.PushString(err.Error())
 		l.Error()
 		return 0
 	}
-	switch len(args) {
-	case 0:
-		l.PushString("")
+	data, err := EncodeYAML(args, opts)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
 		return 0
-	case 1:
-		data, err := yaml.Marshal(args[0])
-		if err != nil {
-			l.PushString(err.Error())
-			l.Error()
-			return 0
-		}
-		l.PushString(string(data))
-		return 1
-	default:
-		b := bytes.NewBuffer([]byte{})
-		encoder := yaml.NewEncoder(b)
-		for p := range args {
-			b.WriteString("---\n")
-			err := encoder.Encode(p)
-			if err != nil {
-				l.PushString(err.Error())
-				l.Error()
-				return 0
-			}
-		}
-		l.PushString(b.String())
-		return 1
 	}
+	l.PushString(data)
+	return 1
+}
+
+// Repr encodes its arguments as a YAML stream
+func Repr(l *lua.State) int {
+	return reprYaml(l, 1, EncodeOptions{EscapeHTML: true})
+}
+
+// ReprWith is Repr taking an options table as first argument
+func ReprWith(l *lua.State) int {
+	return reprYaml(l, 2, encodeOptions(l, 1))
 }
 
 func Parse(l *lua.State) int {
 	s := lua.CheckString(l, 1)
-	var res interface{}
-	err := yaml.Unmarshal([]byte(s), &res)
+	var doc yaml.Node
+	err := yaml.Unmarshal([]byte(s), &doc)
 	if err != nil {
 		l.PushString(err.Error())
 		l.Error()
 		return 0
 	}
-	DeepPush(l, res)
+	res, err := yamlDocument(&doc, optionFlag(l, 2, "ordered"))
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	DeepPushWith(l, res, decodeOptions(l, 2))
+	return 1
+}
+
+// ParseAll decodes every document of a YAML stream into an array
+func ParseAll(l *lua.State) int {
+	s := lua.CheckString(l, 1)
+	decoder := yaml.NewDecoder(strings.NewReader(s))
+	docs := make([]interface{}, 0)
+	ordered := optionFlag(l, 2, "ordered")
+	for {
+		var node yaml.Node
+		err := decoder.Decode(&node)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			l.PushString(err.Error())
+			l.Error()
+			return 0
+		}
+		doc, err := yamlDocument(&node, ordered)
+		if err != nil {
+			l.PushString(err.Error())
+			l.Error()
+			return 0
+		}
+		docs = append(docs, doc)
+	}
+	DeepPushWith(l, docs, decodeOptions(l, 2))
 	return 1
 }
 
 func ParseJson(l *lua.State) int {
 	s := lua.CheckString(l, 1)
 	var res interface{}
-	err := json.Unmarshal([]byte(s), &res)
+	var err error
+	if optionFlag(l, 2, "ordered") {
+		res, err = unmarshalOrderedJSON([]byte(s))
+	} else {
+		err = json.Unmarshal([]byte(s), &res)
+	}
 	if err != nil {
 		l.PushString(err.Error())
 		l.Error()
 		return 0
 	}
-	DeepPush(l, res)
+	DeepPushWith(l, res, decodeOptions(l, 2))
 	return 1
 }
 
+// optionFlag reads a boolean field of the options table at idx, if any
+func optionFlag(l *lua.State, idx int, name string) bool {
+	if !l.IsTable(idx) {
+		return false
+	}
+	l.Field(idx, name)
+	flag := l.ToBoolean(-1)
+	l.Pop(1)
+	return flag
+}
+
+// decodeOptions reads the options table of the decoders:
+// null = true decodes nulls as luabox.null, ordered = true records the key order of objects
+func decodeOptions(l *lua.State, idx int) PushOptions {
+	return PushOptions{Nulls: optionFlag(l, idx, "null")}
+}
+
 func ReprJson(l *lua.State) int {
-	p, err := PullTable(l, 1)
+	opts := encodeOptions(l, 2)
+	p, err := PullTableWith(l, 1, opts.pullOptions(l))
 	if err != nil {
 		l.PushString(err.Error())
 		l.Error()
 		return 0
 	}
-	data, err := json.Marshal(p)
+	data, err := EncodeJSON(p, opts)
 	if err != nil {
 		l.PushString(err.Error())
 		l.Error()
 		return 0
 	}
-	l.PushString(string(data))
+	l.PushString(data)
 	return 1
 }
+
+// checkJSON reports NaN and infinite numbers and strings that are not valid UTF-8, which JSON cannot represent.
+// Binary data must be pulled as []byte to be encoded in base64.
+func checkJSON(v interface{}, path string) error {
+	switch v := v.(type) {
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("cannot encode %v at %s in JSON", v, path)
+		}
+	case string:
+		if !utf8.ValidString(v) {
+			return fmt.Errorf("cannot encode invalid UTF-8 string at %s in JSON", path)
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			if err := checkJSON(e, path+"."+k); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for k, e := range v {
+			if err := checkJSON(e, fmt.Sprintf("%s[%v]", path, k)); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			if err := checkJSON(e, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case OrderedMap:
+		for _, item := range v {
+			if err := checkJSON(item.Value, fmt.Sprintf("%s.%v", path, item.Key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// stringKeys converts the map[interface{}]interface{} of a value to map[string]interface{}, as JSON only has string keys
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			res[fmt.Sprint(k)] = stringKeys(e)
+		}
+		return res
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = stringKeys(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = stringKeys(e)
+		}
+	case OrderedMap:
+		for i := range v {
+			v[i].Value = stringKeys(v[i].Value)
+		}
+	}
+	return v
+}
+
+// yamlBinary converts the []byte of a value to !!binary base64 nodes, instead of sequences of numbers
+func yamlBinary(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!binary", Value: base64.StdEncoding.EncodeToString(v)}
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = yamlBinary(e)
+		}
+	case map[interface{}]interface{}:
+		for k, e := range v {
+			v[k] = yamlBinary(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = yamlBinary(e)
+		}
+	case OrderedMap:
+		for i := range v {
+			v[i].Value = yamlBinary(v[i].Value)
+		}
+	}
+	return v
+}
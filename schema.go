@@ -0,0 +1,745 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Shopify/go-lua"
+	"math"
+	"net"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxSchemaDepth bounds the nesting of schemas applied to a value, guarding against recursive references
+const maxSchemaDepth = 200
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Schema is a compiled JSON Schema, supporting a subset of draft 2020-12: type, enum, const,
+// numeric and string bounds, pattern, format, array and object keywords, combinators, if/then/else
+// and local $ref. As Lua cannot tell them apart, empty objects are also accepted as empty arrays.
+type Schema struct {
+	root    interface{}
+	regexps map[string]*regexp.Regexp
+	// refs are the references already checked
+	refs map[string]bool
+}
+
+// ValidationError is a validation failure, Path being the JSON pointer of the faulty value
+type ValidationError struct {
+	Path    string
+	Keyword string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// CompileSchema compiles a schema pulled from Lua or decoded from JSON
+func CompileSchema(schema interface{}) (*Schema, error) {
+	schema = schemaTree(schema)
+	s := &Schema{root: schema, regexps: make(map[string]*regexp.Regexp), refs: make(map[string]bool)}
+	if err := s.check(schema, "#"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// schemaTree copies a schema, its objects becoming map[string]interface{} so that every schema keeps its identity
+func schemaTree(v interface{}) interface{} {
+	if a, ok := v.([]interface{}); ok {
+		res := make([]interface{}, len(a))
+		for i, e := range a {
+			res[i] = schemaTree(e)
+		}
+		return res
+	}
+	if m, ok := objectOf(v); ok {
+		res := make(map[string]interface{}, len(m))
+		for k, e := range m {
+			res[k] = schemaTree(e)
+		}
+		return res
+	}
+	return v
+}
+
+// ParseSchema compiles a JSON schema document
+func ParseSchema(data []byte) (*Schema, error) {
+	var schema interface{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, err
+	}
+	return CompileSchema(schema)
+}
+
+var schemaKeywords = map[string]string{
+	"items": "schema", "additionalProperties": "schema", "contains": "schema", "not": "schema",
+	"if": "schema", "then": "schema", "else": "schema", "propertyNames": "schema",
+	"properties": "map", "patternProperties": "map", "$defs": "map", "definitions": "map", "dependentSchemas": "map",
+	"prefixItems": "list", "allOf": "list", "anyOf": "list", "oneOf": "list",
+}
+
+// check compiles the patterns of a schema and verifies its structure and references
+func (s *Schema) check(schema interface{}, location string) error {
+	if _, ok := schema.(bool); ok {
+		return nil
+	}
+	sm, ok := objectOf(schema)
+	if !ok {
+		return fmt.Errorf("%s: schema must be an object or a boolean", location)
+	}
+	if pattern, ok := sm["pattern"].(string); ok {
+		if err := s.compile(pattern); err != nil {
+			return fmt.Errorf("%s/pattern: %v", location, err)
+		}
+	}
+	if patterns, ok := objectOf(sm["patternProperties"]); ok {
+		for pattern := range patterns {
+			if err := s.compile(pattern); err != nil {
+				return fmt.Errorf("%s/patternProperties: %v", location, err)
+			}
+		}
+	}
+	if ref, ok := sm["$ref"].(string); ok && !s.refs[ref] {
+		target, err := s.resolve(ref)
+		if err != nil {
+			return fmt.Errorf("%s/$ref: %v", location, err)
+		}
+		// references may target any part of the document, not only the keywords walked below
+		s.refs[ref] = true
+		if err := s.check(target, ref); err != nil {
+			return err
+		}
+	}
+	for keyword, kind := range schemaKeywords {
+		sub, ok := sm[keyword]
+		if !ok {
+			continue
+		}
+		at := location + "/" + keyword
+		switch kind {
+		case "schema":
+			if err := s.check(sub, at); err != nil {
+				return err
+			}
+		case "map":
+			subs, ok := objectOf(sub)
+			if !ok {
+				return fmt.Errorf("%s: expected an object of schemas", at)
+			}
+			for k, e := range subs {
+				if err := s.check(e, at+"/"+pointerEscape(k)); err != nil {
+					return err
+				}
+			}
+		case "list":
+			subs, ok := arrayOf(sub)
+			if !ok {
+				return fmt.Errorf("%s: expected an array of schemas", at)
+			}
+			for i, e := range subs {
+				if err := s.check(e, at+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) compile(pattern string) error {
+	if _, ok := s.regexps[pattern]; ok {
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	s.regexps[pattern] = re
+	return nil
+}
+
+// resolve follows a local reference, "#" or a JSON pointer like "#/$defs/name"
+func (s *Schema) resolve(ref string) (interface{}, error) {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported reference %q, only local references are", ref)
+	}
+	target := s.root
+	if ref == "#" {
+		return target, nil
+	}
+	for _, token := range strings.Split(ref[2:], "/") {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		if m, ok := objectOf(target); ok {
+			if target, ok = m[token]; ok {
+				continue
+			}
+		} else if a, ok := target.([]interface{}); ok {
+			if i, err := strconv.Atoi(token); err == nil && i >= 0 && i < len(a) {
+				target = a[i]
+				continue
+			}
+		}
+		return nil, fmt.Errorf("unresolved reference %q", ref)
+	}
+	return target, nil
+}
+
+// Validate returns the validation errors of a value pulled from Lua or decoded from JSON, none when it is valid
+func (s *Schema) Validate(v interface{}) []ValidationError {
+	vd := &validator{s: s, results: make(map[validation][]ValidationError)}
+	return vd.validate(s.root, v, "")
+}
+
+// validation identifies the application of a schema to the value at a path
+type validation struct {
+	schema uintptr
+	path   string
+}
+
+type validator struct {
+	s     *Schema
+	depth int
+	// results memoises validations, combinators and references applying the same schemas to the same values
+	results map[validation][]ValidationError
+}
+
+func pointerEscape(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
+
+// objectOf returns the entries of a map pulled from Lua, keyed by string
+func objectOf(v interface{}) (map[string]interface{}, bool) {
+	if m, ok := v.(map[string]interface{}); ok {
+		return m, true
+	}
+	items, ok := mapItems(v)
+	if !ok {
+		return nil, false
+	}
+	m := make(map[string]interface{}, len(items))
+	for _, item := range items {
+		m[fmt.Sprint(item.Key)] = item.Value
+	}
+	return m, true
+}
+
+// arrayOf returns the elements of an array pulled from Lua, empty objects being empty arrays
+func arrayOf(v interface{}) ([]interface{}, bool) {
+	if a, ok := v.([]interface{}); ok {
+		return a, true
+	}
+	if items, ok := mapItems(v); ok && len(items) == 0 {
+		return []interface{}{}, true
+	}
+	return nil, false
+}
+
+func numberOf(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func stringOf(v interface{}) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case []byte:
+		return string(s), true
+	}
+	return "", false
+}
+
+// jsonType returns the JSON type name of a value, integer for integral numbers
+func jsonType(v interface{}) string {
+	if v == nil {
+		return "null"
+	}
+	if _, ok := v.(bool); ok {
+		return "boolean"
+	}
+	if n, ok := numberOf(v); ok {
+		if n == math.Trunc(n) && !math.IsInf(n, 0) {
+			return "integer"
+		}
+		return "number"
+	}
+	if _, ok := stringOf(v); ok {
+		return "string"
+	}
+	if _, ok := v.([]interface{}); ok {
+		return "array"
+	}
+	if _, ok := mapItems(v); ok {
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func hasType(v interface{}, name string) bool {
+	actual := jsonType(v)
+	switch name {
+	case actual:
+		return true
+	case "number":
+		return actual == "integer"
+	case "array":
+		_, ok := arrayOf(v)
+		return ok
+	}
+	return false
+}
+
+// jsonEqual compares values as JSON does, numbers by value whatever their Go type
+// and empty objects being equal to empty arrays
+func jsonEqual(a, b interface{}) bool {
+	if na, ok := numberOf(a); ok {
+		nb, ok := numberOf(b)
+		return ok && na == nb
+	}
+	if sa, ok := stringOf(a); ok {
+		sb, ok := stringOf(b)
+		return ok && sa == sb
+	}
+	if aa, ok := a.([]interface{}); ok {
+		ab, ok := arrayOf(b)
+		if !ok || len(aa) != len(ab) {
+			return false
+		}
+		for i := range aa {
+			if !jsonEqual(aa[i], ab[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	if ma, ok := objectOf(a); ok {
+		if ab, ok := b.([]interface{}); ok {
+			return len(ma) == 0 && len(ab) == 0
+		}
+		mb, ok := objectOf(b)
+		if !ok || len(ma) != len(mb) {
+			return false
+		}
+		for k, e := range ma {
+			f, ok := mb[k]
+			if !ok || !jsonEqual(e, f) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func checkFormat(format, s string) bool {
+	switch format {
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	case "date":
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+	case "time":
+		_, err := time.Parse("15:04:05Z07:00", s)
+		return err == nil
+	case "email":
+		a, err := mail.ParseAddress(s)
+		return err == nil && a.Address == s
+	case "ipv4":
+		ip := net.ParseIP(s)
+		return ip != nil && ip.To4() != nil && !strings.Contains(s, ":")
+	case "ipv6":
+		return net.ParseIP(s) != nil && strings.Contains(s, ":")
+	case "uri":
+		u, err := url.Parse(s)
+		return err == nil && u.Scheme != ""
+	case "uuid":
+		return uuidPattern.MatchString(s)
+	}
+	// unknown formats are annotations only
+	return true
+}
+
+func (vd *validator) valid(schema, v interface{}, path string) bool {
+	return len(vd.validate(schema, v, path)) == 0
+}
+
+func (vd *validator) validate(schema, v interface{}, path string) []ValidationError {
+	sm, ok := schema.(map[string]interface{})
+	if !ok {
+		return vd.evaluate(schema, v, path)
+	}
+	key := validation{schema: reflect.ValueOf(sm).Pointer(), path: path}
+	if errs, ok := vd.results[key]; ok {
+		return errs
+	}
+	errs := vd.evaluate(schema, v, path)
+	vd.results[key] = errs
+	return errs
+}
+
+func (vd *validator) evaluate(schema, v interface{}, path string) []ValidationError {
+	errs := make([]ValidationError, 0)
+	fail := func(keyword, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Path: path, Keyword: keyword, Message: fmt.Sprintf(format, args...)})
+	}
+	if b, ok := schema.(bool); ok {
+		if !b {
+			fail("false", "no value is allowed")
+		}
+		return errs
+	}
+	sm, _ := objectOf(schema)
+	if vd.depth >= maxSchemaDepth {
+		fail("$ref", "maximum schema depth of %d exceeded", maxSchemaDepth)
+		return errs
+	}
+	vd.depth++
+	defer func() { vd.depth-- }()
+
+	if ref, ok := sm["$ref"].(string); ok {
+		target, err := vd.s.resolve(ref)
+		if err != nil {
+			fail("$ref", err.Error())
+		} else {
+			errs = append(errs, vd.validate(target, v, path)...)
+		}
+	}
+	if t, ok := sm["type"]; ok {
+		names := make([]string, 0)
+		if name, ok := t.(string); ok {
+			names = append(names, name)
+		} else if list, ok := arrayOf(t); ok {
+			for _, name := range list {
+				names = append(names, fmt.Sprint(name))
+			}
+		}
+		matched := false
+		for _, name := range names {
+			matched = matched || hasType(v, name)
+		}
+		if !matched {
+			fail("type", "expected %s, got %s", strings.Join(names, " or "), jsonType(v))
+		}
+	}
+	if enum, ok := arrayOf(sm["enum"]); ok {
+		found := false
+		for _, e := range enum {
+			found = found || jsonEqual(e, v)
+		}
+		if !found {
+			fail("enum", "value is not one of the %d allowed values", len(enum))
+		}
+	}
+	if c, ok := sm["const"]; ok && !jsonEqual(c, v) {
+		fail("const", "value is not %v", c)
+	}
+
+	if n, ok := numberOf(v); ok {
+		if min, ok := numberOf(sm["minimum"]); ok && n < min {
+			fail("minimum", "%v is less than %v", n, min)
+		}
+		if max, ok := numberOf(sm["maximum"]); ok && n > max {
+			fail("maximum", "%v is greater than %v", n, max)
+		}
+		if min, ok := numberOf(sm["exclusiveMinimum"]); ok && n <= min {
+			fail("exclusiveMinimum", "%v is not greater than %v", n, min)
+		}
+		if max, ok := numberOf(sm["exclusiveMaximum"]); ok && n >= max {
+			fail("exclusiveMaximum", "%v is not less than %v", n, max)
+		}
+		if m, ok := numberOf(sm["multipleOf"]); ok && m > 0 {
+			q := n / m
+			if math.Abs(q-math.Round(q)) > 1e-9 {
+				fail("multipleOf", "%v is not a multiple of %v", n, m)
+			}
+		}
+	}
+
+	if s, ok := stringOf(v); ok {
+		length := utf8.RuneCountInString(s)
+		if min, ok := numberOf(sm["minLength"]); ok && float64(length) < min {
+			fail("minLength", "length %d is less than %v", length, min)
+		}
+		if max, ok := numberOf(sm["maxLength"]); ok && float64(length) > max {
+			fail("maxLength", "length %d is greater than %v", length, max)
+		}
+		if pattern, ok := sm["pattern"].(string); ok && !vd.s.regexps[pattern].MatchString(s) {
+			fail("pattern", "does not match %s", pattern)
+		}
+		if format, ok := sm["format"].(string); ok && !checkFormat(format, s) {
+			fail("format", "is not a valid %s", format)
+		}
+	}
+
+	if a, ok := v.([]interface{}); ok {
+		errs = append(errs, vd.validateArray(sm, a, path)...)
+	} else if m, ok := objectOf(v); ok {
+		if len(m) == 0 {
+			errs = append(errs, vd.validateArray(sm, []interface{}{}, path)...)
+		}
+		errs = append(errs, vd.validateObject(sm, m, path)...)
+	}
+
+	if all, ok := arrayOf(sm["allOf"]); ok {
+		for _, sub := range all {
+			errs = append(errs, vd.validate(sub, v, path)...)
+		}
+	}
+	if any, ok := arrayOf(sm["anyOf"]); ok {
+		matched := false
+		for _, sub := range any {
+			if vd.valid(sub, v, path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("anyOf", "does not match any of the %d schemas", len(any))
+		}
+	}
+	if one, ok := arrayOf(sm["oneOf"]); ok {
+		count := 0
+		for _, sub := range one {
+			if vd.valid(sub, v, path) {
+				count++
+			}
+		}
+		if count != 1 {
+			fail("oneOf", "matches %d of the %d schemas instead of exactly one", count, len(one))
+		}
+	}
+	if not, ok := sm["not"]; ok && vd.valid(not, v, path) {
+		fail("not", "matches a forbidden schema")
+	}
+	if cond, ok := sm["if"]; ok {
+		if vd.valid(cond, v, path) {
+			if then, ok := sm["then"]; ok {
+				errs = append(errs, vd.validate(then, v, path)...)
+			}
+		} else if otherwise, ok := sm["else"]; ok {
+			errs = append(errs, vd.validate(otherwise, v, path)...)
+		}
+	}
+	return errs
+}
+
+func (vd *validator) validateArray(sm map[string]interface{}, a []interface{}, path string) []ValidationError {
+	errs := make([]ValidationError, 0)
+	fail := func(keyword, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Path: path, Keyword: keyword, Message: fmt.Sprintf(format, args...)})
+	}
+	if min, ok := numberOf(sm["minItems"]); ok && float64(len(a)) < min {
+		fail("minItems", "%d items, less than %v", len(a), min)
+	}
+	if max, ok := numberOf(sm["maxItems"]); ok && float64(len(a)) > max {
+		fail("maxItems", "%d items, more than %v", len(a), max)
+	}
+	prefix, _ := arrayOf(sm["prefixItems"])
+	for i, e := range a {
+		itemPath := path + "/" + strconv.Itoa(i)
+		if i < len(prefix) {
+			errs = append(errs, vd.validate(prefix[i], e, itemPath)...)
+		} else if items, ok := sm["items"]; ok {
+			errs = append(errs, vd.validate(items, e, itemPath)...)
+		}
+	}
+	if unique, _ := sm["uniqueItems"].(bool); unique {
+	outer:
+		for i := range a {
+			for j := i + 1; j < len(a); j++ {
+				if jsonEqual(a[i], a[j]) {
+					fail("uniqueItems", "items %d and %d are equal", i, j)
+					break outer
+				}
+			}
+		}
+	}
+	if contains, ok := sm["contains"]; ok {
+		count := 0
+		for i, e := range a {
+			if vd.valid(contains, e, path+"/"+strconv.Itoa(i)) {
+				count++
+			}
+		}
+		min := 1.0
+		if m, ok := numberOf(sm["minContains"]); ok {
+			min = m
+		}
+		if float64(count) < min {
+			fail("contains", "%d items match the contains schema, less than %v", count, min)
+		}
+		if max, ok := numberOf(sm["maxContains"]); ok && float64(count) > max {
+			fail("maxContains", "%d items match the contains schema, more than %v", count, max)
+		}
+	}
+	return errs
+}
+
+func (vd *validator) validateObject(sm map[string]interface{}, m map[string]interface{}, path string) []ValidationError {
+	errs := make([]ValidationError, 0)
+	fail := func(keyword, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Path: path, Keyword: keyword, Message: fmt.Sprintf(format, args...)})
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if min, ok := numberOf(sm["minProperties"]); ok && float64(len(m)) < min {
+		fail("minProperties", "%d properties, less than %v", len(m), min)
+	}
+	if max, ok := numberOf(sm["maxProperties"]); ok && float64(len(m)) > max {
+		fail("maxProperties", "%d properties, more than %v", len(m), max)
+	}
+	if required, ok := arrayOf(sm["required"]); ok {
+		for _, name := range required {
+			if _, ok := m[fmt.Sprint(name)]; !ok {
+				fail("required", "missing property %v", name)
+			}
+		}
+	}
+	if dependent, ok := objectOf(sm["dependentRequired"]); ok {
+		for name, deps := range dependent {
+			if _, ok := m[name]; !ok {
+				continue
+			}
+			list, _ := arrayOf(deps)
+			for _, dep := range list {
+				if _, ok := m[fmt.Sprint(dep)]; !ok {
+					fail("dependentRequired", "property %s requires property %v", name, dep)
+				}
+			}
+		}
+	}
+	properties, _ := objectOf(sm["properties"])
+	patterns, _ := objectOf(sm["patternProperties"])
+	additional, hasAdditional := sm["additionalProperties"]
+	names, hasNames := sm["propertyNames"]
+	for _, k := range keys {
+		propPath := path + "/" + pointerEscape(k)
+		if hasNames {
+			// value paths are empty or start with /, the path of a name must not share their memoised results
+			for _, e := range vd.validate(names, k, "@"+propPath) {
+				fail("propertyNames", "property name %s: %s", k, e.Message)
+			}
+		}
+		matched := false
+		if sub, ok := properties[k]; ok {
+			matched = true
+			errs = append(errs, vd.validate(sub, m[k], propPath)...)
+		}
+		for pattern, sub := range patterns {
+			if vd.s.regexps[pattern].MatchString(k) {
+				matched = true
+				errs = append(errs, vd.validate(sub, m[k], propPath)...)
+			}
+		}
+		if !matched && hasAdditional {
+			if b, ok := additional.(bool); ok && !b {
+				fail("additionalProperties", "property %s is not allowed", k)
+			} else {
+				errs = append(errs, vd.validate(additional, m[k], propPath)...)
+			}
+		}
+	}
+	if dependent, ok := objectOf(sm["dependentSchemas"]); ok {
+		for name, sub := range dependent {
+			if _, ok := m[name]; ok {
+				errs = append(errs, vd.validate(sub, m, path)...)
+			}
+		}
+	}
+	return errs
+}
+
+// ValidateValue validates the Lua value at idx, such as a script result, against a schema
+func ValidateValue(l *lua.State, idx int, s *Schema) ([]ValidationError, error) {
+	v, err := newPuller(l, environmentPullOptions(l)).value(l.AbsIndex(idx), "$")
+	if err != nil {
+		return nil, err
+	}
+	return s.Validate(v), nil
+}
+
+// ValidateArgs validates the environment arguments, as an array of strings, against a schema
+func (e *Environment) ValidateArgs(s *Schema) []ValidationError {
+	args := make([]interface{}, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = arg
+	}
+	return s.Validate(args)
+}
+
+// Validate validates its first argument against the schema given as second argument,
+// returning an array of errors with path, keyword and message fields, empty when the value is valid
+func Validate(l *lua.State) int {
+	p := newPuller(l, environmentPullOptions(l))
+	schema, err := p.value(2, "$")
+	if err == nil && !l.IsTable(2) && !l.IsBoolean(2) {
+		err = errors.New("schema must be a table or a boolean")
+	}
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	s, err := CompileSchema(schema)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	errs, err := ValidateValue(l, 1, s)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	res := make([]interface{}, len(errs))
+	for i, e := range errs {
+		res[i] = map[string]interface{}{"path": e.Path, "keyword": e.Keyword, "message": e.Message}
+	}
+	DeepPush(l, res)
+	return 1
+}
@@ -0,0 +1,256 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/Shopify/go-lua"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"runtime"
+	"unicode"
+)
+
+// JSONRecords decodes a stream of JSON values one at a time: JSON Lines, or any sequence of values,
+// or the elements of a top-level array
+type JSONRecords struct {
+	r       io.Reader
+	br      *bufio.Reader
+	dec     *json.Decoder
+	ordered bool
+	started bool
+	array   bool
+	closed  bool
+	count   int
+}
+
+// NewJSONRecords reads records from r, closed by Close when it is an io.Closer.
+// Ordered records keep the key order of their objects.
+func NewJSONRecords(r io.Reader, ordered bool) *JSONRecords {
+	br := bufio.NewReader(r)
+	return &JSONRecords{r: r, br: br, dec: json.NewDecoder(br), ordered: ordered}
+}
+
+func (s *JSONRecords) start() error {
+	s.started = true
+	for {
+		c, _, err := s.br.ReadRune()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !unicode.IsSpace(c) {
+			s.array = c == '['
+			return s.br.UnreadRune()
+		}
+	}
+}
+
+// Next returns the next record, or io.EOF at the end of the stream
+func (s *JSONRecords) Next() (interface{}, error) {
+	if !s.started {
+		if err := s.start(); err != nil {
+			return nil, err
+		}
+		if s.array {
+			if _, err := s.dec.Token(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !s.dec.More() {
+		if s.array {
+			if _, err := s.dec.Token(); err != nil {
+				return nil, fmt.Errorf("after record %d: %v", s.count, err)
+			}
+		}
+		return nil, io.EOF
+	}
+	s.count++
+	var v interface{}
+	var err error
+	if s.ordered {
+		v, err = orderedJSON(s.dec)
+	} else {
+		err = s.dec.Decode(&v)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("record %d: %v", s.count, err)
+	}
+	return v, nil
+}
+
+// Close closes the underlying reader once, later calls do nothing
+func (s *JSONRecords) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if c, ok := s.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// JSONWriter writes JSON Lines records
+type JSONWriter struct {
+	w    io.Writer
+	opts EncodeOptions
+}
+
+// NewJSONWriter writes records to w, closed by Close when it is an io.Closer
+func NewJSONWriter(w io.Writer, opts EncodeOptions) *JSONWriter {
+	opts.Indent = ""
+	return &JSONWriter{w: w, opts: opts}
+}
+
+// Write encodes a value pulled from Lua as one line
+func (w *JSONWriter) Write(v interface{}) error {
+	s, err := EncodeJSON(v, w.opts)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w.w, s+"\n")
+	return err
+}
+
+func (w *JSONWriter) Close() error {
+	if c, ok := w.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func streamClose(l *lua.State) int {
+	c, ok := l.ToUserData(1).(io.Closer)
+	if !ok {
+		lua.ArgumentError(l, 1, "stream expected")
+		panic("unreachable")
+	}
+	if err := c.Close(); err != nil {
+		lua.Errorf(l, err.Error())
+		panic("unreachable")
+	}
+	return 0
+}
+
+func registerStream(l *lua.State, sample interface{}, extra ...lua.RegistryFunction) {
+	if _, ok := registeredType(l, reflect.TypeOf(sample)); !ok {
+		RegisterType(l, sample, append(extra, lua.RegistryFunction{Name: "close", Function: streamClose})...)
+	}
+}
+
+// recordStream is a source of records, such as JSONRecords or CSVRows
+type recordStream interface {
+	Next() (interface{}, error)
+	Close() error
+}
+
+// openInput opens the file argument at idx on the environment filesystem, or the environment input when absent
+func openInput(l *lua.State, idx int) (io.Reader, error) {
+	env, err := GetEnvironment(l)
+	if err != nil {
+		return nil, err
+	}
+	if file := lua.OptString(l, idx, ""); file != "" {
+		return env.Fs.GetReader(file)
+	}
+	return ioutil.NopCloser(env.Input), nil
+}
+
+// pushRecords pushes an iterator over the records of a stream yielding the record number and value,
+// followed by the stream, which is closed at its end, by its close method, or once garbage collected
+// when a loop exits early
+func pushRecords(l *lua.State, s recordStream, opts PushOptions) int {
+	runtime.SetFinalizer(s, func(s recordStream) { _ = s.Close() })
+	count := 0
+	l.PushGoFunction(func(l *lua.State) int {
+		v, err := s.Next()
+		if err == io.EOF {
+			_ = s.Close()
+			l.PushNil()
+			return 1
+		}
+		if err != nil {
+			_ = s.Close()
+			lua.Errorf(l, err.Error())
+			panic("unreachable")
+		}
+		count++
+		l.PushInteger(count)
+		DeepPushWith(l, v, opts)
+		return 2
+	})
+	registerStream(l, s)
+	PushObject(l, s)
+	return 2
+}
+
+// JSONRecordsOpen returns an iterator over the records of a file of the environment filesystem,
+// or of the environment input when no file is given
+func JSONRecordsOpen(l *lua.State) int {
+	r, err := openInput(l, 1)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	return pushRecords(l, NewJSONRecords(r, optionFlag(l, 2, "ordered")), decodeOptions(l, 2))
+}
+
+// JSONWriterOpen returns a writer of records to a file of the environment filesystem,
+// or to the environment output when no file is given, taking the options of jsonRepr
+func JSONWriterOpen(l *lua.State) int {
+	env, err := GetEnvironment(l)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	var w io.Writer = struct{ io.Writer }{env.Output}
+	if file := lua.OptString(l, 1, ""); file != "" {
+		if w, err = env.Fs.GetWriter(file); err != nil {
+			l.PushString(err.Error())
+			l.Error()
+			return 0
+		}
+	}
+	jw := NewJSONWriter(w, encodeOptions(l, 2))
+	registerStream(l, jw, lua.RegistryFunction{Name: "write", Function: jsonWriterWrite})
+	PushObject(l, jw)
+	return 1
+}
+
+func jsonWriterWrite(l *lua.State) int {
+	var w *JSONWriter
+	CheckObject(l, 1, &w)
+	v, err := newPuller(l, w.opts.pullOptions(l)).value(2, "$")
+	if err == nil {
+		err = w.Write(v)
+	}
+	if err != nil {
+		lua.Errorf(l, err.Error())
+		panic("unreachable")
+	}
+	return 0
+}
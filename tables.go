@@ -0,0 +1,154 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"fmt"
+	"github.com/Shopify/go-lua"
+	"math"
+	"strconv"
+)
+
+// TableTypeField is the metatable field forcing the conversion of a table to an array or an object
+const TableTypeField = "__luabox_type"
+
+const (
+	TableArray  = "array"
+	TableObject = "object"
+)
+
+// maxArrayHoles is the number of holes a table forced to an array may have beyond one per value
+const maxArrayHoles = 64
+
+// tableShape tells whether the table at idx converts to an array, and its length.
+// Tables are arrays when their keys are exactly 1..n, unless their metatable forces the shape.
+// A table forced to an array may be sparse but only have positive integer keys,
+// and no more holes than values plus maxArrayHoles.
+func tableShape(l *lua.State, idx int) (bool, int, error) {
+	idx = l.AbsIndex(idx)
+	forced := ""
+	if lua.MetaField(l, idx, TableTypeField) {
+		forced, _ = l.ToString(-1)
+		l.Pop(1)
+	}
+	count, max, integers := 0, 0, true
+	l.PushNil()
+	for l.Next(idx) {
+		l.Pop(1)
+		count++
+		if k, ok := arrayIndex(l, -1); ok {
+			if k > max {
+				max = k
+			}
+		} else {
+			integers = false
+		}
+	}
+	switch forced {
+	case TableObject:
+		return false, 0, nil
+	case TableArray:
+		if !integers {
+			return false, 0, fmt.Errorf("table marked as array has non positive integer keys")
+		}
+		if max-count > count+maxArrayHoles {
+			return false, 0, fmt.Errorf("table marked as array is too sparse, %d values for a length of %d", count, max)
+		}
+		return true, max, nil
+	}
+	return count > 0 && integers && max == count, count, nil
+}
+
+func arrayIndex(l *lua.State, idx int) (int, bool) {
+	if l.TypeOf(idx) != lua.TypeNumber {
+		return 0, false
+	}
+	f, _ := l.ToNumber(idx)
+	if f < 1 || f != math.Trunc(f) || f > math.MaxInt32 {
+		return 0, false
+	}
+	return int(f), true
+}
+
+// keyString converts a string, number or boolean key without altering it, unlike ToString which would break Next
+func keyString(l *lua.State, idx int) (string, bool) {
+	switch l.TypeOf(idx) {
+	case lua.TypeString:
+		return l.ToString(idx)
+	case lua.TypeBoolean:
+		return strconv.FormatBool(l.ToBoolean(idx)), true
+	case lua.TypeNumber:
+		f, _ := l.ToNumber(idx)
+		if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return strconv.FormatInt(int64(f), 10), true
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), true
+	}
+	return "", false
+}
+
+// setTableType forces the conversion shape of the table at idx.
+// A table with a metatable gets its own copy of it, as the metatable may be shared with other tables.
+func setTableType(l *lua.State, idx int, kind string) {
+	idx = l.AbsIndex(idx)
+	if l.MetaTable(idx) {
+		l.PushString(TableTypeField)
+		l.RawGet(-2)
+		current, _ := l.ToString(-1)
+		l.Pop(1)
+		if current == kind {
+			l.Pop(1)
+			return
+		}
+		l.NewTable()
+		l.PushNil()
+		for l.Next(-3) {
+			// -1: value, -2: key, -3: copy, -4: metatable
+			l.PushValue(-2)
+			l.Insert(-2)
+			l.RawSet(-4)
+		}
+		l.PushString(kind)
+		l.SetField(-2, TableTypeField)
+		l.SetMetaTable(idx)
+		l.Pop(1)
+		return
+	}
+	if lua.NewMetaTable(l, "LUABOX_"+kind) {
+		l.PushString(kind)
+		l.SetField(-2, TableTypeField)
+	}
+	l.SetMetaTable(idx)
+}
+
+func markTable(l *lua.State, kind string) int {
+	lua.CheckType(l, 1, lua.TypeTable)
+	l.SetTop(1)
+	setTableType(l, 1, kind)
+	return 1
+}
+
+// MarkArray forces the table argument to convert to an array, even when empty
+func MarkArray(l *lua.State) int {
+	return markTable(l, TableArray)
+}
+
+// MarkObject forces the table argument to convert to an object, even when empty or a sequence
+func MarkObject(l *lua.State) int {
+	return markTable(l, TableObject)
+}
@@ -0,0 +1,153 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"github.com/Shopify/go-lua"
+	"github.com/pujo-j/luabox"
+	"github.com/pujo-j/luabox/localenv"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+func newTestEnv(t *testing.T) *luabox.Environment {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := localenv.NewEnv(path.Join(wd, "lua"), path.Join(wd, "init"), []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestArchiveLibs(t *testing.T) {
+	b := &bytes.Buffer{}
+	zw := zip.NewWriter(b)
+	files := map[string]string{
+		"bundle/init.lua":  "return { name = 'bundle' }",
+		"bundle/tools.lua": "return { twice = function(x) return 2 * x end }",
+	}
+	for name, code := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write([]byte(code))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	libs, err := luabox.ScanArchive("libs.zip", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := libs["bundle.tools"]; !ok {
+		t.Fatalf("bundle.tools not indexed: %v", libs)
+	}
+	env := newTestEnv(t)
+	for k, v := range env.LuaLibs {
+		libs[k] = v
+	}
+	env.LuaLibs = libs
+	l, err := env.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lua.DoString(l, `
+local b = require('bundle')
+local tools = require('bundle.tools')
+assert(b.name == 'bundle')
+assert(tools.twice(21) == 42)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tarArchive(t *testing.T, w io.Writer, files map[string]string) {
+	tw := tar.NewWriter(w)
+	for name, code := range files {
+		h := &tar.Header{Name: name, Mode: 0644, Size: int64(len(code)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(code)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "bundle/", Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTarArchiveLibs(t *testing.T) {
+	files := map[string]string{
+		"bundle/init.lua":      "return { name = 'bundle' }",
+		"./bundle/tools.lua":   "return {}",
+		"../../escape.lua":     "return 'escape'",
+		"bundle/../inside.lua": "return 'inside'",
+		"README.md":            "not a module",
+	}
+	plain := &bytes.Buffer{}
+	tarArchive(t, plain, files)
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	tarArchive(t, gz, files)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archives := map[string][]byte{
+		"libs.tar":    plain.Bytes(),
+		"libs.tar.gz": compressed.Bytes(),
+		"libs.tgz":    compressed.Bytes(),
+	}
+	for name, data := range archives {
+		libs, err := luabox.ScanArchive(name, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(libs) != 4 {
+			t.Errorf("%s: unexpected modules %v", name, libs)
+		}
+		for _, module := range []string{"bundle", "bundle.tools", "escape", "inside"} {
+			if _, ok := libs[module]; !ok {
+				t.Errorf("%s: %s not indexed", name, module)
+			}
+		}
+		if f := libs["escape"]; f.Name != name+":escape.lua" || f.Code != "return 'escape'" {
+			t.Errorf("%s: entry outside the archive root not kept inside it: %+v", name, f)
+		}
+	}
+	if _, err := luabox.ScanArchive("libs.tar.gz", bytes.NewReader(plain.Bytes())); err == nil {
+		t.Error("plain tar read as tar.gz")
+	}
+	if _, err := luabox.ScanArchive("libs.rar", bytes.NewReader(plain.Bytes())); err == nil {
+		t.Error("unsupported archive format accepted")
+	}
+}
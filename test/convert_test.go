@@ -0,0 +1,180 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package test
+
+import (
+	"github.com/Shopify/go-lua"
+	"github.com/pujo-j/luabox"
+	"strings"
+	"testing"
+)
+
+func TestConversionLimits(t *testing.T) {
+	env := newTestEnv(t)
+	l, err := env.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lua.DoString(l, `
+cyclic = {name = "root", child = {}}
+cyclic.child.parent = cyclic
+deep = {}
+local t = deep
+for i = 1, 10 do
+    t.next = {}
+    t = t.next
+end
+wide = {1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pull := func(name string, opts luabox.PullOptions) (interface{}, error) {
+		l.Global(name)
+		defer l.Pop(1)
+		return luabox.PullTableWith(l, -1, opts)
+	}
+	if _, err := pull("cyclic", luabox.PullOptions{}); err == nil || err.Error() != "pull table, cycle at $.child.parent referencing $" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	v, err := pull("cyclic", luabox.PullOptions{CycleReferences: true})
+	if err != nil || v.(map[string]interface{})["child"].(map[string]interface{})["parent"].(map[string]interface{})["$ref"] != "$" {
+		t.Fatalf("unexpected value %v, %v", v, err)
+	}
+	if _, err := pull("deep", luabox.PullOptions{MaxDepth: 5}); err == nil || !strings.Contains(err.Error(), "maximum depth of 5 exceeded") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := pull("wide", luabox.PullOptions{MaxSize: 5}); err == nil || !strings.Contains(err.Error(), "maximum size of 5 values exceeded") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := pull("wide", luabox.PullOptions{MaxSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	cycle := map[string]interface{}{}
+	cycle["list"] = []interface{}{cycle}
+	nested := map[string]interface{}{}
+	for i, m := 0, nested; i < 10; i++ {
+		next := map[string]interface{}{}
+		m["next"] = next
+		m = next
+	}
+	pushWith := func(v interface{}, opts luabox.PushOptions) lua.Function {
+		return func(l *lua.State) int { return luabox.DeepPushWith(l, v, opts) }
+	}
+	pushes := map[string]lua.Function{
+		"pushCycle":  pushWith(cycle, luabox.PushOptions{}),
+		"pushDeep":   pushWith(nested, luabox.PushOptions{MaxDepth: 5}),
+		"pushWide":   pushWith(make([]int, 10), luabox.PushOptions{MaxSize: 5}),
+		"pushBounds": pushWith(make([]int, 10), luabox.PushOptions{MaxSize: 11}),
+	}
+	for name, f := range pushes {
+		l.Register(name, f)
+	}
+	err = lua.DoString(l, `
+local ok, err = pcall(pushCycle)
+assert(not ok and err:find("cycle at $.list[1] referencing $", 1, true), err)
+ok, err = pcall(pushDeep)
+assert(not ok and err:find("maximum depth of 5 exceeded at $.next.next.next.next.next", 1, true), err)
+ok, err = pcall(pushWide)
+assert(not ok and err:find("maximum size of 5 values exceeded at $[5]", 1, true), err)
+assert(#pushBounds() == 10)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFloatConversion(t *testing.T) {
+	l, err := newTestEnv(t).Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lua.DoString(l, "numbers = {1.5, 2, -0.25, 1e300}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Global("numbers")
+	defer l.Pop(1)
+	v, err := luabox.PullTableWith(l, -1, luabox.PullOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auto := v.([]interface{})
+	if auto[0] != 1.5 || auto[1] != 2 || auto[2] != -0.25 || auto[3] != 1e300 {
+		t.Fatalf("unexpected auto conversion %#v", auto)
+	}
+	v, err = luabox.PullTableWith(l, -1, luabox.PullOptions{Numbers: luabox.NumberFloat})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if floats := v.([]interface{}); floats[0] != 1.5 || floats[1] != 2.0 {
+		t.Fatalf("unexpected float conversion %#v", floats)
+	}
+
+	runData(t, `
+assert(data.toJson({1.5, 2, -0.25}) == '[1.5,2,-0.25]', data.toJson({1.5, 2, -0.25}))
+assert(data.fromJson(data.toJson({x = 0.1})).x == 0.1)
+assert(data.fromYaml(data.toYaml({x = 2.75})).x == 2.75)
+local ok, err = pcall(data.toJson, {x = 0/0})
+assert(not ok and err:find("in JSON", 1, true), err)
+`)
+}
+
+func TestTableKeys(t *testing.T) {
+	l, err := newTestEnv(t).Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lua.DoString(l, `
+mixed = {[true] = 'yes', [2.5] = 'half', [10] = 'ten', a = 1}
+tableKey = {[{}] = 1}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pull := func(name string, opts luabox.PullOptions) (interface{}, error) {
+		l.Global(name)
+		defer l.Pop(1)
+		return luabox.PullTableWith(l, -1, opts)
+	}
+	v, err := pull("mixed", luabox.PullOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs := v.(map[string]interface{})
+	if strs["true"] != "yes" || strs["2.5"] != "half" || strs["10"] != "ten" || strs["a"] != 1 {
+		t.Fatalf("unexpected string keys %#v", strs)
+	}
+	v, err = pull("mixed", luabox.PullOptions{Keys: luabox.KeysInterface})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := v.(map[interface{}]interface{})
+	if keys[true] != "yes" || keys[2.5] != "half" || keys[10] != "ten" || keys["a"] != 1 {
+		t.Fatalf("unexpected interface keys %#v", keys)
+	}
+	if _, err := pull("tableKey", luabox.PullOptions{Keys: luabox.KeysInterface}); err == nil || !strings.Contains(err.Error(), "unsupported key type table") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	runData(t, `
+local doc = data.fromJson(data.toJson({[true] = 1, [1.5] = 2, x = 3}))
+assert(doc['true'] == 1 and doc['1.5'] == 2 and doc.x == 3)
+`)
+}
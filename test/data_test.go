@@ -0,0 +1,582 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package test
+
+import (
+	"fmt"
+	"github.com/Shopify/go-lua"
+	"github.com/pujo-j/luabox"
+	"github.com/pujo-j/luabox/localenv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func runData(t *testing.T, code string) {
+	env := newTestEnv(t)
+	l, err := env.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lua.DoString(l, "local data = require('data')\n"+code); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNullRoundTrip(t *testing.T) {
+	runData(t, `
+local doc = data.fromJson('{"a":null,"list":[1,null,3]}', {null = true})
+assert(doc.a == data.null)
+assert(#doc.list == 3 and doc.list[2] == data.null)
+assert(tostring(data.null) == "null")
+assert(data.toJson(doc) == '{"a":null,"list":[1,null,3]}')
+local plain = data.fromJson('{"a":null}')
+assert(plain.a == nil)
+local y = data.fromYaml("a: ~\nb: 1\n", {null = true})
+assert(y.a == data.null)
+assert(data.fromYaml(data.toYaml(y), {null = true}).a == data.null)
+`)
+}
+
+func TestYamlStream(t *testing.T) {
+	runData(t, `
+local s = data.toYamlAll({{kind = "Service"}, {kind = "Deployment"}, {kind = "ConfigMap"}})
+assert(s == "kind: Service\n---\nkind: Deployment\n---\nkind: ConfigMap\n", s)
+local docs = data.fromYamlAll(s)
+assert(#docs == 3 and docs[2].kind == "Deployment")
+assert(#data.fromYamlAll("") == 0)
+`)
+}
+
+func TestOrderedRoundTrip(t *testing.T) {
+	runData(t, `
+local doc = data.fromJson('{"zeta":1,"alpha":{"y":true,"x":[1,2]},"mid":"m"}', {ordered = true})
+doc.added = 2
+doc.mid = nil
+assert(data.toJson(doc) == '{"zeta":1,"alpha":{"y":true,"x":[1,2]},"added":2}', data.toJson(doc))
+local keys = data.keys(doc)
+assert(keys[1] == "zeta" and keys[2] == "alpha" and keys[3] == "added")
+local base = "name: app\nversion: 2\nbuild:\n  step: compile\n  cache: true\n"
+local y = data.fromYaml(base, {ordered = true})
+y.version = 3
+assert(data.toYaml(y) == "name: app\nversion: 3\nbuild:\n    step: compile\n    cache: true\n", data.toYaml(y))
+local merged = data.fromYaml("base: &b {a: 1, b: 2}\nchild:\n  b: 3\n  <<: *b\n", {ordered = true})
+assert(merged.child.a == 1 and merged.child.b == 3)
+`)
+}
+
+func TestYamlAliasBomb(t *testing.T) {
+	runData(t, `
+local lines = {'l0: &l0 ["x", "x", "x", "x", "x", "x", "x", "x", "x", "x"]'}
+for i = 1, 8 do
+    lines[#lines + 1] = "l" .. i .. ": &l" .. i .. " [" .. string.rep("*l" .. (i - 1) .. ", ", 9) .. "*l" .. (i - 1) .. "]"
+end
+local src = table.concat(lines, "\n")
+local ok, err = pcall(data.fromYaml, src, {ordered = true})
+assert(not ok and err:find("through aliases"), err)
+ok, err = pcall(data.yamlDocument(src).get, data.yamlDocument(src), "l8")
+assert(not ok and err:find("through aliases"), err)
+assert(not pcall(data.fromYaml, src))
+local merged = data.fromYaml("base: &b {a: 1}\nx: {<<: *b, c: 2}\n", {ordered = true})
+assert(merged.x.a == 1 and merged.x.c == 2)
+`)
+}
+
+func TestYamlDocument(t *testing.T) {
+	runData(t, `
+local src = [[
+# service settings
+name: api # public name
+image:
+  tag: "1.2.0" # bumped by CI
+ports:
+- 80
+- 443
+defaults: &defaults
+  retries: 3
+]]
+local doc = data.yamlDocument(src)
+assert(doc:get("image.tag") == "1.2.0")
+assert(doc:get({"ports", 2}) == 443)
+assert(doc:get("missing.key") == nil)
+doc:set("image.tag", "1.3.0")
+doc:insert("ports", 8080)
+doc:insert("ports", 22, 1)
+assert(doc:remove("ports[2]"))
+doc:set("labels.team", "core")
+local out = doc:toString()
+assert(out == [[
+# service settings
+name: api # public name
+image:
+  tag: "1.3.0" # bumped by CI
+ports:
+- 22
+- 443
+- 8080
+defaults: &defaults
+  retries: 3
+labels:
+  team: core
+]], out)
+`)
+}
+
+func TestEncodeOptions(t *testing.T) {
+	runData(t, `
+local v = {b = "<x>", a = {1, 2}}
+assert(data.toJson(v) == '{"a":[1,2],"b":"\\u003cx\\u003e"}', data.toJson(v))
+assert(data.toJson(v, {escapeHTML = false}) == '{"a":[1,2],"b":"<x>"}')
+assert(data.toJson(v, {indent = 2}) == '{\n  "a": [\n    1,\n    2\n  ],\n  "b": "\\u003cx\\u003e"\n}')
+local ordered = data.fromJson('{"z":"<","y":1}', {ordered = true})
+assert(data.toJson(ordered) == '{"z":"\\u003c","y":1}', data.toJson(ordered))
+assert(data.toJson(ordered, {canonical = true}) == '{"y":1,"z":"<"}')
+assert(data.toYaml({a = {b = 1}}, {indent = 2}) == "a:\n  b: 1\n")
+assert(data.toYaml({a = {1, 2}}, {flow = true}) == "{a: [1, 2]}\n", data.toYaml({a = {1, 2}}, {flow = true}))
+assert(data.toJson(v, {indent = "\t"}) == '{\n\t"a": [\n\t\t1,\n\t\t2\n\t],\n\t"b": "\\u003cx\\u003e"\n}')
+local ok, err = pcall(data.toJson, v, {indent = -1})
+assert(not ok and err:find("indent must be between 0 and 16"), err)
+assert(not pcall(data.toYaml, v, {indent = 100}))
+assert(not pcall(data.toJson, v, {indent = "x"}))
+`)
+}
+
+func TestJSONRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	env := newTestEnv(t)
+	env.Fs = &localenv.Fs{BaseDir: dir}
+	env.Input = strings.NewReader(`[{"id": 1}, {"id": 2}, null, {"id": 4}]`)
+	l, err := env.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lua.DoString(l, `
+local data = require('data')
+local out = data.jsonWriter("events.jsonl")
+local n = 0
+for i, event in data.jsonRecords(nil, {null = true}) do
+    n = i
+    if event ~= data.null then
+        out:write({id = event.id, seen = true})
+    end
+end
+out:close()
+assert(n == 4)
+local ids = {}
+for _, event in data.jsonRecords("events.jsonl") do
+    assert(event.seen)
+    ids[#ids + 1] = event.id
+end
+assert(#ids == 3 and ids[3] == 4)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "events.jsonl"))
+	if err != nil || string(b) != "{\"id\":1,\"seen\":true}\n{\"id\":2,\"seen\":true}\n{\"id\":4,\"seen\":true}\n" {
+		t.Fatalf("unexpected records %q, %v", b, err)
+	}
+}
+
+// trackingFs counts the readers left open
+type trackingFs struct {
+	luabox.Filesystem
+	open int32
+}
+
+type trackedReader struct {
+	io.ReadCloser
+	fs *trackingFs
+}
+
+func (r *trackedReader) Close() error {
+	atomic.AddInt32(&r.fs.open, -1)
+	return r.ReadCloser.Close()
+}
+
+func (fs *trackingFs) GetReader(file string) (io.ReadCloser, error) {
+	r, err := fs.Filesystem.GetReader(file)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&fs.open, 1)
+	return &trackedReader{ReadCloser: r, fs: fs}, nil
+}
+
+// checkReadersClosed runs code and waits for the readers it left open to be released by the garbage collector
+func checkReadersClosed(t *testing.T, files map[string]string, code string) {
+	dir, err := ioutil.TempDir("", "streams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := &trackingFs{Filesystem: &localenv.Fs{BaseDir: dir}}
+	env := newTestEnv(t)
+	env.Fs = fs
+	l, err := env.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lua.DoString(l, "local data = require('data')\n"+code); err != nil {
+		t.Fatal(err)
+	}
+	l.SetTop(0)
+	for i := 0; i < 50 && atomic.LoadInt32(&fs.open) > 0; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if open := atomic.LoadInt32(&fs.open); open != 0 {
+		t.Fatalf("%d readers left open", open)
+	}
+}
+
+func TestJSONRecordsRelease(t *testing.T) {
+	checkReadersClosed(t, map[string]string{"events.jsonl": "{\"id\": 1}\n{\"id\": 2}\n{\"id\": 3}\n"}, `
+for _ = 1, 3 do
+    for _, event in data.jsonRecords("events.jsonl") do
+        if event.id == 2 then
+            break
+        end
+    end
+end
+local iter, records = data.jsonRecords("events.jsonl")
+records:close()
+records:close()
+for _ in data.jsonRecords("events.jsonl") do end
+`)
+}
+
+func TestCSVRowsRelease(t *testing.T) {
+	checkReadersClosed(t, map[string]string{"rows.csv": "id\n1\n2\n3\n", "rows.tsv": "1\t2\n3\t4\n"}, `
+for _, row in data.csvRows("rows.csv", {header = true}) do
+    if row.id == "2" then
+        break
+    end
+end
+for _, row in data.csvRows("rows.tsv", {separator = "\t", header = false}) do
+    break
+end
+local ok, err = pcall(data.csvRows, "rows.csv", {separator = "\n"})
+assert(not ok and err:find("separator", 1, true), err)
+`)
+}
+
+func TestTextCodecs(t *testing.T) {
+	runData(t, `
+local cfg = data.fromToml('title = "app"\n[server]\nport = 8080\nhosts = ["a", "b"]\n')
+assert(cfg.title == "app" and cfg.server.port == 8080 and cfg.server.hosts[2] == "b")
+local again = data.fromToml(data.toToml(cfg))
+assert(again.server.port == 8080)
+
+local rows = data.fromCsv('name,qty\nbolt,"1,5"\nnut,3\n')
+assert(#rows == 2 and rows[1].qty == "1,5" and rows[2].name == "nut")
+assert(data.toCsv(rows) == 'name,qty\nbolt,"1,5"\nnut,3\n', data.toCsv(rows))
+assert(data.toCsv({{1, "x"}}, {header = false, quoteAll = true}) == '"1","x"\n')
+local tsv = data.fromTsv('a\tb\n1\t2\n', {header = false})
+assert(tsv[2][2] == "2")
+assert(data.toTsv({{a = 1, b = 2}}) == 'a\tb\n1\t2\n')
+local ok, err = pcall(data.toCsv, {{1}}, {separator = '"', quoteAll = true})
+assert(not ok and err:find("invalid separator"), err)
+assert(not pcall(data.fromCsv, "a\n", {separator = "\n"}))
+
+local ini = data.fromIni('top = 1\n; comment\n[db]\nhost = "localhost"\nport: 5432 ; inline\n')
+assert(ini.top == "1" and ini.db.host == "localhost" and ini.db.port == "5432")
+assert(data.toIni(ini) == 'top = 1\n\n[db]\nhost = localhost\nport = 5432\n', data.toIni(ini))
+local quoted = data.fromIni('h = "localhost" ; c\nq = "a ; b" # c\nr = \'it\'\'s\'\ns = "say \\"hi\\" ; x"\n')
+assert(quoted.h == "localhost" and quoted.q == "a ; b" and quoted.r == "'it''s'" and quoted.s == 'say "hi" ; x', quoted.s)
+local tricky = {s = {a = '"quoted"', b = " pad ", c = 'say "hi" ; x', d = "C:\\dir"}}
+local back = data.fromIni(data.toIni(tricky))
+for k, v in pairs(tricky.s) do
+    assert(back.s[k] == v, k)
+end
+ok, err = pcall(data.toIni, {s = {k = "x\n[evil]\ny = 1"}})
+assert(not ok and err:find("line break"), err)
+assert(not pcall(data.toIni, {["a]"] = {k = 1}}))
+assert(not pcall(data.toIni, {["k = v"] = 1}))
+`)
+}
+
+func TestBinaryCodecs(t *testing.T) {
+	runData(t, `
+local v = {count = 3, ratio = 0.5, blob = "\255\0", list = {1, 2.5, true}, [10] = "ten"}
+for _, codec in ipairs({{data.toMsgpack, data.fromMsgpack}, {data.toCbor, data.fromCbor}}) do
+    local encoded = codec[1](v)
+    local back = codec[2](encoded)
+    assert(back.count == 3 and back.ratio == 0.5 and back.blob == "\255\0")
+    assert(back.list[2] == 2.5 and back.list[3] == true and back[10] == "ten")
+    assert(codec[1](back) == encoded)
+end
+assert(data.toMsgpack(1) == "\1" and data.toMsgpack(1.5) == "\203\63\248\0\0\0\0\0\0")
+assert(data.toCbor(1) == "\1" and data.fromCbor("\1") == 1)
+local ok, err = pcall(data.fromMsgpack, "\129\145\1\2")
+assert(not ok and err:find("invalid map key type"), err)
+assert(not pcall(data.fromCbor, "\161\129\1\2"))
+`)
+}
+
+func TestMsgpackLengths(t *testing.T) {
+	inputs := map[string]string{
+		"map32":   "\xdf\x7f\xff\xff\xff",
+		"map16":   "\xde\xff\xff\x01",
+		"array32": "\xdd\x7f\xff\xff\xff",
+		"str32":   "\xdb\x7f\xff\xff\xff",
+		"bin32":   "\xc6\x7f\xff\xff\xff",
+		"nested":  "\x81\x01\xdf\x7f\xff\xff\xff",
+	}
+	for name, input := range inputs {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, err := luabox.DecodeMsgpack([]byte(input)); err == nil {
+			t.Errorf("%s: decoded a truncated input", name)
+		}
+		runtime.ReadMemStats(&after)
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+			t.Errorf("%s: allocated %d bytes for a %d bytes input", name, alloc, len(input))
+		}
+	}
+}
+
+func TestSchemaValidation(t *testing.T) {
+	runData(t, `
+local schema = {
+    type = "object",
+    required = {"name", "ports"},
+    additionalProperties = false,
+    properties = {
+        name = {type = "string", pattern = "^[a-z]+$"},
+        ports = {type = "array", minItems = 1, items = {["$ref"] = "#/$defs/port"}},
+        tags = {type = "array", uniqueItems = true},
+        mode = {enum = {"fast", "safe"}},
+    },
+    ["$defs"] = {port = {type = "integer", minimum = 1, maximum = 65535}},
+}
+assert(#data.validate({name = "web", ports = {80, 443}, tags = {}}, schema) == 0)
+local errs = data.validate({name = "Web", ports = {80, 70000, 1.5}, mode = "slow", extra = 1}, schema)
+local seen = {}
+for _, e in ipairs(errs) do
+    seen[e.path .. " " .. e.keyword] = true
+end
+assert(#errs == 5, #errs)
+assert(seen["/name pattern"] and seen["/ports/1 maximum"] and seen["/ports/2 type"])
+assert(seen["/mode enum"] and seen[" additionalProperties"] and seen["/ports/2 maximum"] == nil)
+assert(#data.validate("x", {oneOf = {{type = "string"}, {minLength = 1}}}) == 1)
+assert(not pcall(data.validate, 1, {pattern = "("}))
+local ref = {["$ref"] = "#/components/s", components = {s = {pattern = "^x"}}}
+assert(#data.validate("xy", ref) == 0 and data.validate("y", ref)[1].keyword == "pattern")
+local ok, err = pcall(data.validate, "x", {["$ref"] = "#/components/s", components = {s = {pattern = "("}}})
+assert(not ok and err:find("#/components/s/pattern", 1, true), err)
+assert(#data.validate({a = {a = {}}}, {properties = {a = {["$ref"] = "#"}}}) == 0)
+local names = {propertyNames = {anyOf = {{minLength = 2}, {pattern = "^_"}}}}
+errs = data.validate({ab = 1, x = 2, _ = 3, cd = 4}, names)
+assert(#errs == 1 and errs[1].message:find("property name x", 1, true), #errs)
+`)
+	env := newTestEnv(t)
+	env.Args = []string{"deploy", "--force"}
+	s, err := luabox.ParseSchema([]byte(`{"type":"array","prefixItems":[{"enum":["deploy","build"]}],"items":{"pattern":"^--"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := env.ValidateArgs(s); len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	env.Args = []string{"run", "force"}
+	errs := env.ValidateArgs(s)
+	if len(errs) != 2 || errs[0].Error() != "/0: value is not one of the 2 allowed values" || errs[1].Path != "/1" {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+}
+
+func TestSchemaCombinators(t *testing.T) {
+	// each level tries the next one twice, 2^40 validations without memoisation
+	defs := make([]string, 0)
+	for i := 0; i < 40; i++ {
+		next := fmt.Sprintf(`{"$ref": "#/$defs/a%d"}`, i+1)
+		defs = append(defs, fmt.Sprintf(`"a%d": {"anyOf": [%s, %s]}`, i, next, next))
+	}
+	defs = append(defs, `"a40": {"type": "string"}`)
+	s, err := luabox.ParseSchema([]byte(`{"$ref": "#/$defs/a0", "$defs": {` + strings.Join(defs, ",") + `}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan []luabox.ValidationError, 1)
+	go func() { done <- s.Validate([]interface{}{1, 2}) }()
+	select {
+	case errs := <-done:
+		if len(errs) != 1 || errs[0].Keyword != "anyOf" {
+			t.Fatalf("unexpected errors %v", errs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("validation did not complete")
+	}
+	if errs := s.Validate("x"); len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	runData(t, `
+local doc = data.fromJson([[{"store": {"name": "corner", "books": [
+    {"title": "Dune", "price": 9.5, "tags": ["sf"]},
+    {"title": "Emma", "price": 12, "tags": ["classic", "romance"]},
+    {"title": "Ubik", "price": 7, "isbn": "0-679"}
+]}}]])
+local function join(list)
+    local out = {}
+    for i, v in ipairs(list) do
+        out[i] = tostring(v)
+    end
+    return table.concat(out, ",")
+end
+assert(join(data.query(doc, "$.store.books[*].title")) == "Dune,Emma,Ubik")
+assert(join(data.query(doc, "$.store.books[0,-1].title")) == "Dune,Ubik")
+assert(join(data.query(doc, "$.store.books[1:].title")) == "Emma,Ubik")
+assert(join(data.query(doc, "$.store.books[:-1].title")) == "Dune,Emma")
+assert(join(data.query(doc, ".store.books[0].tags[0]")) == "sf")
+assert(join(data.query(doc, "$..price")) == "9.5,12,7")
+assert(join(data.query(doc, "$.store.books[?(@.price < 10 && @.title =~ '^D')].title")) == "Dune")
+assert(join(data.query(doc, "$.store.books[?@.isbn].title")) == "Ubik")
+assert(join(data.query(doc, "$.store['name']")) == "corner")
+assert(#data.query(doc, "$.store.missing") == 0)
+assert(join(data.query(doc, ".store.books | map(select(.price > 8) | .title)")[1]) == "Dune,Emma")
+assert(join(data.query(doc, ".store.books[] | .tags | length")) == "1,2")
+assert(join(data.query(doc, ".store | keys")[1]) == "books,name")
+assert(data.query({a = false}, ".a | not")[1] == true)
+assert(data.query({a = 1}, ".b")[1] == nil)
+local ok, err = pcall(data.query, doc, "$.store[")
+assert(not ok and err:find("unexpected end of expression"), err)
+ok, err = pcall(data.query, doc, string.rep("(", 1000) .. "1" .. string.rep(")", 1000))
+assert(not ok and err:find("too deeply nested"), err)
+`)
+}
+
+func TestMergeAndPatch(t *testing.T) {
+	runData(t, `
+local base = {name = "app", env = {A = "1", B = "2"}, ports = {80}, users = {{id = 1, role = "dev"}, {id = 2, role = "ops"}}}
+local overlay = {env = {B = "3", C = "4"}, ports = {443}, users = {{id = 2, role = "admin"}, {id = 3, role = "dev"}}}
+local merged = data.merge(base, overlay)
+assert(merged.name == "app" and merged.env.A == "1" and merged.env.B == "3" and merged.env.C == "4")
+assert(#merged.ports == 1 and merged.ports[1] == 443 and #merged.users == 2)
+assert(base.env.B == "2")
+merged = data.merge(base, overlay, {arrays = "append"})
+assert(#merged.ports == 2 and merged.ports[2] == 443)
+merged = data.merge(base, overlay, {arrays = "by-key", key = "id"})
+assert(#merged.users == 3 and merged.users[2].role == "admin" and merged.users[3].id == 3)
+assert(not pcall(data.merge, base, overlay, {arrays = "by-key"}))
+
+local a = data.fromJson('{"a":1,"b":{"c":[1,2,3]},"d":"x"}', {ordered = true})
+local b = data.fromJson('{"a":2,"b":{"c":[1,5]},"e":true}', {ordered = true})
+local ops = data.diff(a, b)
+assert(data.toJson(ops) == '[{"op":"remove","path":"/d"},{"op":"replace","path":"/a","value":2},' ..
+    '{"op":"replace","path":"/b/c/1","value":5},{"op":"remove","path":"/b/c/2"},{"op":"add","path":"/e","value":true}]',
+    data.toJson(ops))
+assert(data.toJson(data.patch(a, ops)) == data.toJson(b))
+assert(#data.diff(b, b) == 0)
+
+local doc = data.patch({list = {1, 2}}, {
+    {op = "add", path = "/list/-", value = 3},
+    {op = "copy", from = "/list", path = "/copy"},
+    {op = "move", from = "/list/0", path = "/first"},
+    {op = "test", path = "/copy/2", value = 3},
+    {op = "add", path = "/k~1v", value = data.null},
+})
+assert(data.toJson(doc) == '{"list":[2,3],"copy":[1,2,3],"first":1,"k/v":null}', data.toJson(doc))
+local ok, err = pcall(data.patch, doc, {{op = "test", path = "/first", value = 2}})
+assert(not ok and err:find("operation 1 (test /first): test failed", 1, true), err)
+ok, err = pcall(data.patch, doc, {{op = "remove", path = "/list/5"}})
+assert(not ok and err:find("out of bounds"), err)
+
+local patched = data.mergePatch({a = "b", c = {d = "e", f = "g"}}, {a = "z", c = {f = data.null}})
+assert(patched.a == "z" and patched.c.d == "e" and patched.c.f == nil)
+assert(data.mergePatch({a = 1}, "x") == "x")
+`)
+}
+
+func TestMergeEdgeCases(t *testing.T) {
+	runData(t, `
+assert(data.toJson(data.patch({list = {}}, {{op = "add", path = "/list/-", value = 1}})) == '{"list":[1]}')
+assert(data.toJson(data.patch({list = {}}, {{op = "add", path = "/list/0", value = 1}})) == '{"list":[1]}')
+assert(data.toJson(data.patch({}, {{op = "add", path = "/a", value = 1}})) == '{"a":1}')
+assert(data.toJson(data.patch({list = {}}, {{op = "test", path = "/list", value = data.array({})}})) == '{"list":{}}')
+assert(data.toJson(data.merge({ports = {80}}, {ports = {}}, {arrays = "append"})) == '{"ports":[80]}')
+assert(data.toJson(data.merge({ports = {80}}, {ports = {}})) == '{"ports":[]}')
+assert(data.toJson(data.merge({ports = {}}, {ports = {443}}, {arrays = "append"})) == '{"ports":[443]}')
+assert(data.toJson(data.diff({list = {}}, {list = {1}})) == '[{"op":"add","path":"/list/0","value":1}]')
+assert(#data.diff({list = {}}, {list = data.array({})}) == 0)
+
+`)
+}
+
+func TestMergeLargeObjects(t *testing.T) {
+	a, b := make(map[string]interface{}), make(map[string]interface{})
+	for i := 0; i < 20000; i++ {
+		a[fmt.Sprint("k", i)] = int64(i)
+		b[fmt.Sprint("k", i+10000)] = []interface{}{int64(i)}
+	}
+	merged, err := luabox.MergeValues(a, b, luabox.MergeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(merged.(luabox.OrderedMap)); n != 30000 {
+		t.Fatalf("expected 30000 keys, got %d", n)
+	}
+	if ops := luabox.DiffValues(a, merged); len(ops) != 20000 {
+		t.Fatalf("expected 20000 operations, got %d", len(ops))
+	}
+	patched := luabox.ApplyMergePatch(merged, map[string]interface{}{"k1": nil, "k2": int64(5)})
+	if n := len(patched.(luabox.OrderedMap)); n != 29999 {
+		t.Fatalf("expected 29999 keys, got %d", n)
+	}
+}
+
+func TestFsWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := &localenv.Fs{BaseDir: dir}
+	for _, content := range []string{"a longer first content", "short"} {
+		w, err := fs.GetWriter("out.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "out.txt"))
+	if err != nil || string(b) != "short" {
+		t.Fatalf("unexpected content %q, %v", b, err)
+	}
+}
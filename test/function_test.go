@@ -0,0 +1,110 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package test
+
+import (
+	"context"
+	"github.com/Shopify/go-lua"
+	"github.com/pujo-j/luabox"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLuaFunction(t *testing.T) {
+	env := newTestEnv(t)
+	l, err := env.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handlers := make(map[string]*luabox.LuaFunction)
+	luabox.DeepPush(l, func(event string, handler *luabox.LuaFunction) {
+		handlers[event] = handler
+	})
+	l.SetGlobal("on")
+	err = lua.DoString(l, `
+on("order.created", function(e) return e.id * 2, "ok" end)
+on("loop", function() while true do end end)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := handlers["order.created"].Call(context.Background(), map[string]interface{}{"id": 21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0] != 42.0 || res[1] != "ok" {
+		t.Fatalf("unexpected results %v", res)
+	}
+	cyclic := map[string]interface{}{"id": 1}
+	cyclic["self"] = cyclic
+	top := l.Top()
+	if _, err := handlers["order.created"].Call(context.Background(), cyclic); err == nil || !strings.Contains(err.Error(), "cycle at $.self") {
+		t.Fatalf("expected a cycle error, got %v", err)
+	}
+	if l.Top() != top {
+		t.Fatalf("stack not restored after a failed call, top %d instead of %d", l.Top(), top)
+	}
+	if _, err := handlers["order.created"].Call(context.Background(), map[string]interface{}{"id": 1}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := handlers["loop"].Call(ctx); err == nil {
+		t.Fatal("expected the call to be interrupted")
+	}
+	handlers["order.created"].Release()
+	if _, err := handlers["order.created"].Call(context.Background()); err != luabox.ErrReleased {
+		t.Fatalf("expected ErrReleased, got %v", err)
+	}
+	luabox.ReleaseFunctions(l)
+}
+
+func TestPullFunctions(t *testing.T) {
+	env := newTestEnv(t)
+	l, err := env.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lua.LoadString(l, "return 1"); err != nil {
+		t.Fatal(err)
+	}
+	args, err := luabox.PullVarargs(l, 1)
+	if err != nil || len(args) != 1 || args[0] != nil {
+		t.Fatalf("unexpected arguments %v, %v", args, err)
+	}
+	l.Field(lua.RegistryIndex, "LUABOX_REFS_VALUES")
+	if !l.IsNil(-1) {
+		t.Fatal("a function reference was created without the Functions option")
+	}
+	l.Pop(1)
+	env.PullOptions.Functions = true
+	args, err = luabox.PullVarargs(l, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, ok := args[0].(*luabox.LuaFunction)
+	if !ok {
+		t.Fatalf("expected a LuaFunction, got %T", args[0])
+	}
+	defer f.Release()
+	res, err := f.Call(context.Background())
+	if err != nil || len(res) != 1 || res[0] != 1.0 {
+		t.Fatalf("unexpected results %v, %v", res, err)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package test
+
+import (
+	"github.com/Shopify/go-lua"
+	"github.com/pujo-j/luabox"
+	"os"
+	"testing"
+)
+
+func TestChunkModes(t *testing.T) {
+	compiled, err := luabox.CompileLuaFile(luabox.LuaFile{Name: "compiled.lua", Code: "return 'binary'"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	libs, err := luabox.CompileLibs(map[string]luabox.LuaFile{
+		"precompiled": {Name: "precompiled.lua", Code: "return { name = 'precompiled' }"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, dir := newModulesEnv(t, map[string]string{
+		"text.lua":     "return 'text'",
+		"compiled.lua": compiled.Code,
+	})
+	defer os.RemoveAll(dir)
+	// env.LuaLibs is shared with luabox.BaseLibs, the library must not leak into other tests
+	for k, v := range env.LuaLibs {
+		libs[k] = v
+	}
+	env.LuaLibs = libs
+	l, err := env.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.PushString(compiled.Code)
+	l.SetGlobal("compiled")
+	err = lua.DoString(l, `
+assert(loadfile('text.lua')() == 'text')
+assert(loadfile('text.lua', 'bt')() == 'text')
+local f, err = loadfile('compiled.lua')
+assert(not f, 'binary chunks must be refused by default')
+assert(not loadfile('compiled.lua', 'bt'))
+f, err = loadfile('compiled.lua', 'b')
+assert(not f and err:find('binary chunks are disabled', 1, true), err)
+assert(not load(compiled))
+assert(not pcall(dofile, 'compiled.lua'))
+assert(require('precompiled').name == 'precompiled', 'LuaLibs are trusted')
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env.AllowBinaryChunks = true
+	l, err = env.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.PushString(compiled.Code)
+	l.SetGlobal("compiled")
+	err = lua.DoString(l, `
+local function check(file, mode, expected)
+  local f, err = loadfile(file, mode)
+  if expected then
+    assert(f, err)
+    assert(f() == expected, file .. ' with mode ' .. tostring(mode))
+  else
+    assert(not f, file .. ' loaded with mode ' .. tostring(mode))
+  end
+end
+for _, mode in ipairs({'t', 'bt', 'text'}) do
+  check('text.lua', mode, 'text')
+end
+for _, mode in ipairs({'b', 'bt', 'binary'}) do
+  check('compiled.lua', mode, 'binary')
+end
+check('compiled.lua', nil, 'binary')
+check('text.lua', 'b', nil)
+check('compiled.lua', 't', nil)
+local f, err = loadfile('text.lua', 'x')
+assert(not f and err:find('invalid file mode', 1, true), err)
+assert(load(compiled)() == 'binary')
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSandboxedLoad(t *testing.T) {
+	l, err := newTestEnv(t).Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lua.DoString(l, `
+secret = 'global'
+local env = { x = 21 }
+local f = assert(load('y = x * 2 return secret', 'chunk', 't', env))
+assert(f() == nil, 'chunk saw the global table')
+assert(env.y == 42 and y == nil, 'chunk did not write to its env')
+
+local parts, i = { 'return ', 'x ', '+ 1' }, 0
+f = assert(load(function() i = i + 1 return parts[i] end, nil, nil, env))
+assert(f() == 22)
+
+f = assert(load('return secret'))
+assert(f() == 'global', 'chunk without env must use _G')
+
+local _, err = pcall(assert(load('error("boom")', 'named')))
+assert(err:find('named:1:', 1, true), err)
+_, err = load('return +', '=custom')
+assert(err:find('custom:1:', 1, true), err)
+
+local crafted = '\27Lua\82\0\1\4\8\4\8\0'
+for _, mode in ipairs({'b', 'bt'}) do
+  assert(not load(crafted, 'crafted', mode), 'binary chunk loaded with mode ' .. mode)
+end
+f, err = load(crafted)
+assert(not f and err:find('attempt to load a binary chunk', 1, true), err)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
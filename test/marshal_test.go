@@ -0,0 +1,118 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package test
+
+import (
+	"github.com/Shopify/go-lua"
+	"github.com/pujo-j/luabox"
+	"testing"
+	"time"
+)
+
+type Server struct {
+	Host string `lua:"host"`
+	Port int    `json:"port"`
+}
+
+type Config struct {
+	Name    string            `lua:"name"`
+	Servers []Server          `lua:"servers"`
+	Labels  map[string]string `lua:"labels,omitempty"`
+	Since   time.Time         `lua:"since"`
+	Ratio   *float64          `lua:"ratio,omitempty"`
+	Secret  []byte            `lua:"secret"`
+	Ignored string            `lua:"-"`
+}
+
+func TestStructRoundTrip(t *testing.T) {
+	env := newTestEnv(t)
+	l, err := env.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ratio := 0.5
+	in := Config{
+		Name:    "prod",
+		Servers: []Server{{Host: "a", Port: 80}, {Host: "b", Port: 8080}},
+		Since:   time.Date(2020, 5, 6, 12, 0, 0, 0, time.UTC),
+		Ratio:   &ratio,
+		Secret:  []byte("s3cr3t"),
+		Ignored: "x",
+	}
+	luabox.DeepPush(l, in)
+	l.SetGlobal("config")
+	err = lua.DoString(l, `
+assert(config.name == "prod")
+assert(config.servers[2].port == 8080)
+assert(config.labels == nil)
+assert(config.since == "2020-05-06T12:00:00Z")
+assert(config.secret == "s3cr3t")
+assert(config.Ignored == nil)
+config.servers[1].port = 443
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Global("config")
+	var out Config
+	if err := luabox.PullInto(l, -1, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Servers[0].Port != 443 || !out.Since.Equal(in.Since) || *out.Ratio != 0.5 || string(out.Secret) != "s3cr3t" {
+		t.Fatalf("unexpected decoded value %+v", out)
+	}
+	err = lua.DoString(l, `config.servers[2].port = "http"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Global("config")
+	err = luabox.PullInto(l, -1, &out)
+	if err == nil || err.Error() != "$.servers[2].port: expected number, got string" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestBinaryStrings(t *testing.T) {
+	env := newTestEnv(t)
+	l, err := env.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	luabox.DeepPush(l, []byte{0xff, 0x00, 'a'})
+	l.SetGlobal("blob")
+	err = lua.DoString(l, `
+local data = require('data')
+assert(#blob == 3 and blob:byte(1) == 255)
+assert(not pcall(data.toJson, {blob = blob}))
+local back = data.fromYaml(data.toYaml({blob = blob}))
+assert(back.blob == blob)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Global("blob")
+	b, err := luabox.PullBytes(l, -1)
+	if err != nil || string(b) != "\xff\x00a" {
+		t.Fatalf("unexpected bytes %q, %v", b, err)
+	}
+	env.PullOptions.Bytes = true
+	err = lua.DoString(l, `assert(require('data').toJson({blob = blob}) == '{"blob":"/wBh"}')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
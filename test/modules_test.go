@@ -0,0 +1,151 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package test
+
+import (
+	"github.com/Shopify/go-lua"
+	"github.com/pujo-j/luabox"
+	"github.com/pujo-j/luabox/localenv"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// newModulesEnv creates an environment whose lua directory holds the given files, the caller removes the directory
+func newModulesEnv(t *testing.T, files map[string]string) (*luabox.Environment, string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "luabox-modules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, code := range files {
+		err = ioutil.WriteFile(path.Join(dir, name), []byte(code), 0644)
+		if err != nil {
+			_ = os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	env, err := localenv.NewEnv(dir, path.Join(wd, "init"), []string{})
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return env, dir
+}
+
+func TestModuleTrace(t *testing.T) {
+	env, dir := newModulesEnv(t, map[string]string{
+		"a.lua": "local b = require('b')\nreturn { b = b }",
+		"b.lua": "return { name = 'b' }",
+	})
+	defer os.RemoveAll(dir)
+	l, err := env.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lua.DoString(l, `
+require('a')
+assert(not pcall(require, 'missing'))
+local modules = luabox.modules()
+local last = modules[#modules]
+assert(last.name == 'missing', last.name)
+assert(last.error ~= '')
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loads := make(map[string]luabox.ModuleLoad)
+	for _, load := range env.Modules(l) {
+		loads[load.Name] = load
+	}
+	a, b := loads["a"], loads["b"]
+	if a.Searcher != "filesystem" || a.Parent != "" || a.ETag == "" || a.Error != "" {
+		t.Errorf("unexpected load of a: %+v", a)
+	}
+	if b.Searcher != "filesystem" || b.Parent != "a" || path.Base(b.File) != "b.lua" {
+		t.Errorf("unexpected load of b: %+v", b)
+	}
+	if loads["missing"].Error == "" {
+		t.Errorf("missing module has no error: %+v", loads["missing"])
+	}
+	if other := newTestEnv(t); other.Modules(l) != nil {
+		t.Error("modules of a state listed by another environment")
+	}
+}
+
+func TestReloader(t *testing.T) {
+	env, dir := newModulesEnv(t, map[string]string{
+		"counter.lua": "return { version = 1, stale = true, count = 0 }",
+	})
+	defer os.RemoveAll(dir)
+	l, err := env.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lua.DoString(l, `
+counter = require('counter')
+counter.count = 3
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := luabox.NewReloader(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded := r.Check(); len(reloaded) != 0 {
+		t.Fatalf("nothing changed, reloaded %v", reloaded)
+	}
+	update := func(code string, mtime time.Time) {
+		file := path.Join(dir, "counter.lua")
+		if err := ioutil.WriteFile(file, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update(`local m = { version = 2, count = 0 }
+function m.__reload(old) m.count = old.count end
+return m`, time.Now().Add(time.Minute))
+	if reloaded := r.Check(); len(reloaded) != 1 || reloaded[0] != "counter" {
+		t.Fatalf("expected counter to be reloaded, got %v", reloaded)
+	}
+	err = lua.DoString(l, `
+assert(counter == require('counter'), 'module table was replaced')
+assert(counter.version == 2, 'module was not patched')
+assert(counter.stale == nil, 'stale field was kept')
+assert(counter.count == 3, '__reload did not carry over state')
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update("return { version = ", time.Now().Add(2*time.Minute))
+	if reloaded := r.Check(); len(reloaded) != 0 {
+		t.Fatalf("broken module was reloaded: %v", reloaded)
+	}
+	err = lua.DoString(l, "assert(require('counter').version == 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,44 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package test
+
+import "testing"
+
+func TestTableMarkers(t *testing.T) {
+	runData(t, `
+assert(data.toJson({}) == "{}" and data.toJson({1, 2}) == "[1,2]" and data.toJson({1, x = 2}) == '{"1":1,"x":2}')
+assert(data.toJson(data.array({})) == "[]")
+assert(data.toJson(data.object({1, 2})) == '{"1":1,"2":2}')
+assert(data.toJson(data.array({[1] = "a", [3] = "c"})) == '["a",null,"c"]')
+
+local empty = data.fromJson('{"a":[]}').a
+data.object(empty)
+assert(data.toJson(empty) == "{}")
+assert(data.toJson(data.fromJson("[]")) == "[]")
+
+local mt = {__index = {kind = "shared"}}
+local x, y = setmetatable({}, mt), setmetatable({}, mt)
+data.array(x)
+assert(data.toJson(x) == "[]" and data.toJson(y) == "{}" and x.kind == "shared")
+
+local ok, err = pcall(data.toJson, data.array({[2147483647] = 1}))
+assert(not ok and err:find("too sparse"), err)
+ok, err = pcall(data.toJson, data.array({a = 1}))
+assert(not ok and err:find("non positive integer keys"), err)
+`)
+}
@@ -0,0 +1,143 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Shopify/go-lua"
+	"github.com/pujo-j/luabox"
+	"testing"
+)
+
+type Account struct {
+	Owner   string
+	Balance int `lua:"balance"`
+}
+
+func (a *Account) Deposit(amount int) int {
+	a.Balance += amount
+	return a.Balance
+}
+
+func (a *Account) Withdraw(amount int) (int, error) {
+	if amount > a.Balance {
+		return a.Balance, errors.New("insufficient funds")
+	}
+	a.Balance -= amount
+	return a.Balance, nil
+}
+
+func (a *Account) String() string {
+	return fmt.Sprintf("account of %s", a.Owner)
+}
+
+func TestUserData(t *testing.T) {
+	env := newTestEnv(t)
+	l, err := env.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	luabox.RegisterType(l, &Account{})
+	account := &Account{Owner: "alice", Balance: 10}
+	luabox.DeepPush(l, map[string]interface{}{"account": account})
+	l.SetGlobal("bank")
+	l.PushGoFunction(func(l *lua.State) int {
+		var a *Account
+		luabox.CheckObject(l, 1, &a)
+		l.PushString(a.Owner)
+		return 1
+	})
+	l.SetGlobal("owner")
+	err = lua.DoString(l, `
+local a = bank.account
+assert(a:Deposit(5) == 15)
+assert(a.balance == 15 and a.Owner == "alice")
+local ok, err = pcall(a.Withdraw, a, 100)
+assert(not ok and err:find("insufficient funds"))
+a.Owner = "bob"
+assert(tostring(a) == "account of bob")
+assert(a == bank.account)
+assert(owner(a) == "bob")
+assert(not pcall(owner, {}))
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 15 || account.Owner != "bob" {
+		t.Fatalf("unexpected account %+v", account)
+	}
+}
+
+func TestPushFunctionsAndChannels(t *testing.T) {
+	env := newTestEnv(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	env.Context = ctx
+	l, err := env.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	numbers := make(chan int, 2)
+	results := make(chan string, 1)
+	luabox.DeepPush(l, map[string]interface{}{
+		"add": func(a, b int) int { return a + b },
+		"raw": lua.Function(func(l *lua.State) int {
+			l.PushString("raw")
+			return 1
+		}),
+		"numbers":  numbers,
+		"results":  (chan<- string)(results),
+		"incoming": (<-chan int)(numbers),
+	})
+	l.SetGlobal("go")
+	err = lua.DoString(l, `
+assert(go.add(20, 22) == 42)
+assert(go.raw() == 'raw')
+go.numbers:send(1)
+go.numbers:send(2)
+local v, ok = go.incoming:recv()
+assert(v == 1 and ok)
+go.results:send('done')
+assert(not pcall(go.results.recv, go.results), 'recv on a send-only channel')
+assert(not pcall(go.incoming.send, go.incoming, 3), 'send on a receive-only channel')
+go.numbers:close()
+v, ok = go.numbers:recv()
+assert(v == 2 and ok)
+v, ok = go.numbers:recv()
+assert(v == nil and ok == false)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := <-results; r != "done" {
+		t.Fatalf("unexpected result %q", r)
+	}
+
+	cancel()
+	luabox.DeepPush(l, make(chan int))
+	l.SetGlobal("blocked")
+	err = lua.DoString(l, `
+local ok, err = pcall(blocked.recv, blocked)
+assert(not ok and err:find('context done', 1, true), err)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
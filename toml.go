@@ -0,0 +1,56 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"bytes"
+	"github.com/BurntSushi/toml"
+	"github.com/Shopify/go-lua"
+)
+
+func ParseToml(l *lua.State) int {
+	s := lua.CheckString(l, 1)
+	var res map[string]interface{}
+	_, err := toml.Decode(s, &res)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	DeepPush(l, res)
+	return 1
+}
+
+func ReprToml(l *lua.State) int {
+	opts := environmentPullOptions(l)
+	p, err := PullTableWith(l, 1, opts)
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	b := &bytes.Buffer{}
+	err = toml.NewEncoder(b).Encode(stringKeys(p))
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	l.PushString(b.String())
+	return 1
+}
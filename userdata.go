@@ -0,0 +1,351 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"fmt"
+	"github.com/Shopify/go-lua"
+	"reflect"
+)
+
+const typesKey = "LUABOX_TYPES"
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+type objectType struct {
+	name  string
+	extra map[string]lua.Function
+}
+
+type typeRegistry struct {
+	types map[reflect.Type]*objectType
+}
+
+func getTypeRegistry(l *lua.State) *typeRegistry {
+	l.Field(lua.RegistryIndex, typesKey)
+	registry, ok := l.ToUserData(-1).(*typeRegistry)
+	l.Pop(1)
+	if !ok {
+		registry = &typeRegistry{types: make(map[reflect.Type]*objectType)}
+		l.PushUserData(registry)
+		l.SetField(lua.RegistryIndex, typesKey)
+	}
+	return registry
+}
+
+func registeredType(l *lua.State, t reflect.Type) (*objectType, bool) {
+	l.Field(lua.RegistryIndex, typesKey)
+	registry, ok := l.ToUserData(-1).(*typeRegistry)
+	l.Pop(1)
+	if !ok {
+		return nil, false
+	}
+	ot, ok := registry.types[t]
+	return ot, ok
+}
+
+func typeName(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		return "*" + typeName(t.Elem())
+	}
+	if t.Name() != "" && t.PkgPath() != "" {
+		return t.PkgPath() + "." + t.Name()
+	}
+	return t.String()
+}
+
+// RegisterType makes DeepPush push the values of the type of sample as userdata,
+// exposing their exported methods (called with ':') and fields through a metatable.
+// Extra functions are exposed as methods, receiving the userdata as first argument.
+func RegisterType(l *lua.State, sample interface{}, extra ...lua.RegistryFunction) {
+	t := reflect.TypeOf(sample)
+	ot := &objectType{name: "luabox:" + typeName(t), extra: make(map[string]lua.Function)}
+	for _, f := range extra {
+		ot.extra[f.Name] = f.Function
+	}
+	getTypeRegistry(l).types[t] = ot
+	lua.NewMetaTable(l, ot.name)
+	lua.SetFunctions(l, []lua.RegistryFunction{
+		{"__index", func(l *lua.State) int { return objectIndex(l, ot) }},
+		{"__newindex", objectNewIndex},
+		{"__tostring", objectToString},
+		{"__eq", objectEq},
+	}, 0)
+	l.PushString(t.String())
+	l.SetField(-2, "__name")
+	l.Pop(1)
+}
+
+// PushObject pushes a Go value as userdata, registering its type if needed
+func PushObject(l *lua.State, v interface{}) {
+	t := reflect.TypeOf(v)
+	ot, ok := registeredType(l, t)
+	if !ok {
+		RegisterType(l, v)
+		ot, _ = registeredType(l, t)
+	}
+	l.PushUserData(v)
+	lua.SetMetaTableNamed(l, ot.name)
+}
+
+// ToObject stores in the variable target points to the userdata value at idx,
+// returning false when idx is not a userdata assignable to that variable
+func ToObject(l *lua.State, idx int, target interface{}) bool {
+	ud := l.ToUserData(idx)
+	if ud == nil {
+		return false
+	}
+	tv := reflect.ValueOf(target).Elem()
+	uv := reflect.ValueOf(ud)
+	if !uv.Type().AssignableTo(tv.Type()) {
+		return false
+	}
+	tv.Set(uv)
+	return true
+}
+
+// CheckObject is ToObject raising an argument error on mismatch
+func CheckObject(l *lua.State, idx int, target interface{}) {
+	if !ToObject(l, idx, target) {
+		expected := reflect.TypeOf(target).Elem().String()
+		lua.ArgumentError(l, idx, fmt.Sprintf("%s expected, got %s", expected, lua.TypeNameOf(l, idx)))
+		panic("unreachable")
+	}
+}
+
+// objectField finds a field by lua or json tag, then by Go name, in a struct or pointer to struct
+func objectField(v reflect.Value, key string) (reflect.Value, bool) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	for _, f := range structFields(v.Type()) {
+		if f.name == key {
+			return v.FieldByIndex(f.index), true
+		}
+	}
+	if f, ok := v.Type().FieldByName(key); ok && f.PkgPath == "" {
+		return v.FieldByIndex(f.Index), true
+	}
+	return reflect.Value{}, false
+}
+
+func objectIndex(l *lua.State, ot *objectType) int {
+	obj := l.ToUserData(1)
+	key := lua.CheckString(l, 2)
+	if f, ok := ot.extra[key]; ok {
+		l.PushGoFunction(f)
+		return 1
+	}
+	v := reflect.ValueOf(obj)
+	if m := v.MethodByName(key); m.IsValid() {
+		l.PushGoFunction(func(l *lua.State) int { return callReflect(l, m, 2) })
+		return 1
+	}
+	if f, ok := objectField(v, key); ok {
+		return DeepPush(l, f.Interface())
+	}
+	l.PushNil()
+	return 1
+}
+
+func objectNewIndex(l *lua.State) int {
+	obj := l.ToUserData(1)
+	key := lua.CheckString(l, 2)
+	f, ok := objectField(reflect.ValueOf(obj), key)
+	if !ok || !f.CanSet() {
+		lua.Errorf(l, "cannot set field '%s' of %T", key, obj)
+		panic("unreachable")
+	}
+	d := &decoder{puller: newPuller(l, environmentPullOptions(l))}
+	if err := d.decode(3, f, key); err != nil {
+		lua.Errorf(l, err.Error())
+		panic("unreachable")
+	}
+	return 0
+}
+
+func objectToString(l *lua.State) int {
+	switch obj := l.ToUserData(1).(type) {
+	case fmt.Stringer:
+		l.PushString(obj.String())
+	case error:
+		l.PushString(obj.Error())
+	default:
+		l.PushString(fmt.Sprintf("%T: %v", obj, obj))
+	}
+	return 1
+}
+
+func objectEq(l *lua.State) int {
+	a, b := l.ToUserData(1), l.ToUserData(2)
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	if ta != tb {
+		l.PushBoolean(false)
+	} else if ta.Comparable() {
+		l.PushBoolean(a == b)
+	} else {
+		l.PushBoolean(reflect.DeepEqual(a, b))
+	}
+	return 1
+}
+
+// callReflect calls a Go function with the Lua arguments from index first on,
+// converted like PullInto. A non nil error last result is raised, other results are pushed with DeepPush.
+func callReflect(l *lua.State, fn reflect.Value, first int) int {
+	t := fn.Type()
+	nArgs := l.Top() - first + 1
+	if nArgs < 0 {
+		nArgs = 0
+	}
+	fixed := t.NumIn()
+	if t.IsVariadic() {
+		fixed--
+	}
+	d := &decoder{puller: newPuller(l, environmentPullOptions(l))}
+	in := make([]reflect.Value, 0, t.NumIn())
+	for i := 0; i < fixed; i++ {
+		v := reflect.New(t.In(i)).Elem()
+		if err := d.decode(first+i, v, fmt.Sprintf("argument #%d", i+1)); err != nil {
+			lua.Errorf(l, err.Error())
+			panic("unreachable")
+		}
+		in = append(in, v)
+	}
+	if t.IsVariadic() {
+		elem := t.In(fixed).Elem()
+		for i := fixed; i < nArgs; i++ {
+			v := reflect.New(elem).Elem()
+			if err := d.decode(first+i, v, fmt.Sprintf("argument #%d", i+1)); err != nil {
+				lua.Errorf(l, err.Error())
+				panic("unreachable")
+			}
+			in = append(in, v)
+		}
+	}
+	out := fn.Call(in)
+	if n := len(out); n > 0 && t.Out(n-1) == errorType {
+		if err, _ := out[n-1].Interface().(error); err != nil {
+			lua.Errorf(l, err.Error())
+			panic("unreachable")
+		}
+		out = out[:n-1]
+	}
+	for _, o := range out {
+		DeepPush(l, o.Interface())
+	}
+	return len(out)
+}
+
+var luaFunctionType = reflect.TypeOf(lua.Function(nil))
+
+func pushFunc(l *lua.State, v reflect.Value) {
+	if v.IsNil() {
+		l.PushNil()
+		return
+	}
+	if v.Type().ConvertibleTo(luaFunctionType) {
+		l.PushGoFunction(v.Convert(luaFunctionType).Interface().(lua.Function))
+		return
+	}
+	l.PushGoFunction(func(l *lua.State) int { return callReflect(l, v, 1) })
+}
+
+// pushChannel pushes a channel as userdata with send(v), recv() returning the value and false once closed, and close()
+func pushChannel(l *lua.State, v reflect.Value) {
+	if v.IsNil() {
+		l.PushNil()
+		return
+	}
+	if _, ok := registeredType(l, v.Type()); !ok {
+		RegisterType(l, v.Interface(),
+			lua.RegistryFunction{Name: "send", Function: channelSend},
+			lua.RegistryFunction{Name: "recv", Function: channelRecv},
+			lua.RegistryFunction{Name: "close", Function: channelClose})
+	}
+	PushObject(l, v.Interface())
+}
+
+func checkChannel(l *lua.State, dir reflect.ChanDir) reflect.Value {
+	ch := reflect.ValueOf(l.ToUserData(1))
+	if ch.Kind() != reflect.Chan {
+		lua.ArgumentError(l, 1, "channel expected")
+		panic("unreachable")
+	}
+	if ch.Type().ChanDir()&dir == 0 {
+		lua.ArgumentError(l, 1, "channel direction does not allow this operation")
+		panic("unreachable")
+	}
+	return ch
+}
+
+func contextDone(l *lua.State) reflect.Value {
+	if env, ok := lookupEnvironment(l); ok && env.Context != nil {
+		return reflect.ValueOf(env.Context.Done())
+	}
+	return reflect.ValueOf((<-chan struct{})(nil))
+}
+
+func channelSend(l *lua.State) int {
+	ch := checkChannel(l, reflect.SendDir)
+	d := &decoder{puller: newPuller(l, environmentPullOptions(l))}
+	v := reflect.New(ch.Type().Elem()).Elem()
+	if err := d.decode(2, v, "argument #1"); err != nil {
+		lua.Errorf(l, err.Error())
+		panic("unreachable")
+	}
+	chosen, _, _ := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: ch, Send: v},
+		{Dir: reflect.SelectRecv, Chan: contextDone(l)},
+	})
+	if chosen == 1 {
+		lua.Errorf(l, "send interrupted: context done")
+		panic("unreachable")
+	}
+	return 0
+}
+
+func channelClose(l *lua.State) int {
+	checkChannel(l, reflect.SendDir).Close()
+	return 0
+}
+
+func channelRecv(l *lua.State) int {
+	ch := checkChannel(l, reflect.RecvDir)
+	chosen, v, ok := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: ch},
+		{Dir: reflect.SelectRecv, Chan: contextDone(l)},
+	})
+	if chosen == 1 {
+		lua.Errorf(l, "receive interrupted: context done")
+		panic("unreachable")
+	}
+	if !ok {
+		l.PushNil()
+		l.PushBoolean(false)
+		return 2
+	}
+	DeepPush(l, v.Interface())
+	l.PushBoolean(true)
+	return 2
+}
@@ -21,7 +21,11 @@ import (
 	"errors"
 	"fmt"
 	"github.com/Shopify/go-lua"
+	"math"
 	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 func PullStringTable(l *lua.State, idx int) (map[string]string, error) {
@@ -52,22 +56,120 @@ func PullStringTable(l *lua.State, idx int) (map[string]string, error) {
 	return table, nil
 }
 
+// NumberMode selects how Lua numbers are converted to Go values
+type NumberMode int
+
+const (
+	// NumberAuto converts integral numbers to int and other numbers to float64, as PullTable always did
+	NumberAuto NumberMode = iota
+	// NumberFloat converts all numbers to float64
+	NumberFloat
+)
+
+// DefaultMaxDepth bounds the nesting of converted values when no maximum is configured
+const DefaultMaxDepth = 200
+
+// KeyMode selects how the keys of non array tables are converted
+type KeyMode int
+
+const (
+	// KeysString converts tables to map[string]interface{}, number and boolean keys being stringified
+	KeysString KeyMode = iota
+	// KeysInterface converts tables to map[interface{}]interface{}, keeping number and boolean keys
+	KeysInterface
+)
+
+// PullOptions tunes the conversion of Lua tables to Go values
+type PullOptions struct {
+	Numbers NumberMode
+	Keys    KeyMode
+	// MaxDepth bounds the nesting of tables, DefaultMaxDepth when 0
+	MaxDepth int
+	// MaxSize bounds the total number of converted values, unlimited when 0
+	MaxSize int
+	// CycleReferences converts a table found inside itself to {["$ref"] = path of the enclosing table}
+	// instead of failing
+	CycleReferences bool
+	// Bytes converts strings that are not valid UTF-8 to []byte, which encoders write as base64
+	Bytes bool
+	// Ordered converts tables recording their key order, as made by ordered decoding, to OrderedMap
+	Ordered bool
+	// Functions converts Lua function arguments of PullVarargs to LuaFunction handles, which the caller
+	// must release, instead of nil
+	Functions bool
+}
+
 func PullTable(l *lua.State, idx int) (interface{}, error) {
+	return PullTableWith(l, idx, environmentPullOptions(l))
+}
+
+func PullTableWith(l *lua.State, idx int, opts PullOptions) (interface{}, error) {
 	if !l.IsTable(idx) {
 		return nil, fmt.Errorf("need a table at index %d, got %s", idx, lua.TypeNameOf(l, idx))
 	}
 
-	return pullTableRec(l, idx)
+	return newPuller(l, opts).table(idx, "$")
+}
+
+// environmentPullOptions returns the conversion options of the state environment, if any
+func environmentPullOptions(l *lua.State) PullOptions {
+	env, ok := lookupEnvironment(l)
+	if !ok {
+		return PullOptions{}
+	}
+	return env.PullOptions
+}
+
+type puller struct {
+	l    *lua.State
+	opts PullOptions
+	size int
+	// tables being converted, by path
+	ancestors map[interface{}]string
 }
 
-func pullTableRec(l *lua.State, idx int) (interface{}, error) {
+func newPuller(l *lua.State, opts PullOptions) *puller {
+	if opts.MaxDepth == 0 {
+		opts.MaxDepth = DefaultMaxDepth
+	}
+	return &puller{l: l, opts: opts, ancestors: make(map[interface{}]string)}
+}
+
+func (p *puller) table(idx int, path string) (interface{}, error) {
+	l := p.l
 	if !l.CheckStack(2) {
 		return nil, errors.New("pull table, stack exhausted")
 	}
 
 	idx = l.AbsIndex(idx)
-	if isArray(l, idx) {
-		return pullArrayRec(l, idx)
+	ref := l.ToValue(idx)
+	if ancestor, ok := p.ancestors[ref]; ok {
+		if p.opts.CycleReferences {
+			return map[string]interface{}{"$ref": ancestor}, nil
+		}
+		return nil, fmt.Errorf("pull table, cycle at %s referencing %s", path, ancestor)
+	}
+	if len(p.ancestors) >= p.opts.MaxDepth {
+		return nil, fmt.Errorf("pull table, maximum depth of %d exceeded at %s", p.opts.MaxDepth, path)
+	}
+	p.ancestors[ref] = path
+	defer delete(p.ancestors, ref)
+
+	array, length, err := tableShape(l, idx)
+	if err != nil {
+		return nil, fmt.Errorf("pull table, %v at %s", err, path)
+	}
+	if array {
+		return p.array(idx, path, length)
+	}
+
+	if p.opts.Ordered && lua.MetaField(l, idx, TableOrderField) {
+		l.Pop(1)
+		return p.ordered(idx, path)
+	}
+
+	if p.opts.Keys == KeysInterface {
+		return p.interfaceMap(idx, path)
 	}
 
 	table := make(map[string]interface{})
@@ -75,14 +177,14 @@ func pullTableRec(l *lua.State, idx int) (interface{}, error) {
 	l.PushNil()
 	for l.Next(idx) {
 		// -1: value, -2: key, ..., idx: table
-		key, ok := l.ToString(-2)
+		key, ok := keyString(l, -2)
 		if !ok {
 			err := fmt.Errorf("key should be a string (%s)", lua.TypeNameOf(l, -2))
 			l.Pop(2)
 			return nil, err
 		}
 
-		value, err := toGoValue(l, -1)
+		value, err := p.value(-1, path+"."+key)
 		if err != nil {
 			l.Pop(2)
 			return nil, err
@@ -96,31 +198,57 @@ func pullTableRec(l *lua.State, idx int) (interface{}, error) {
 	return table, nil
 }
 
-func isArray(l *lua.State, idx int) bool {
-	if !l.IsTable(idx) {
-		return false
-	}
-	l.Length(idx)
-	length, ok := l.ToInteger(-1)
-	l.Pop(1)
-	if ok && length > 0 {
-		return true
+func (p *puller) interfaceMap(idx int, path string) (interface{}, error) {
+	l := p.l
+	table := make(map[interface{}]interface{})
+
+	l.PushNil()
+	for l.Next(idx) {
+		var key interface{}
+		switch l.TypeOf(-2) {
+		case lua.TypeString:
+			key, _ = l.ToString(-2)
+		case lua.TypeNumber:
+			f, _ := l.ToNumber(-2)
+			key = goNumber(f, p.opts.Numbers)
+		case lua.TypeBoolean:
+			key = l.ToBoolean(-2)
+		default:
+			err := fmt.Errorf("unsupported key type %s at %s", lua.TypeNameOf(l, -2), path)
+			l.Pop(2)
+			return nil, err
+		}
+
+		value, err := p.value(-1, fmt.Sprintf("%s[%v]", path, key))
+		if err != nil {
+			l.Pop(2)
+			return nil, err
+		}
+
+		table[key] = value
+
+		l.Pop(1)
 	}
-	return false
+
+	return table, nil
 }
 
-func pullArrayRec(l *lua.State, idx int) (interface{}, error) {
-	table := make([]interface{}, lua.LengthEx(l, idx))
+func (p *puller) array(idx int, path string, length int) (interface{}, error) {
+	l := p.l
+	if p.opts.MaxSize > 0 && p.size+length > p.opts.MaxSize {
+		return nil, fmt.Errorf("pull table, maximum size of %d values exceeded at %s", p.opts.MaxSize, path)
+	}
+	table := make([]interface{}, length)
 
 	l.PushNil()
 	for l.Next(idx) {
-		k, ok := l.ToInteger(-2)
+		k, ok := arrayIndex(l, -2)
 		if !ok {
 			l.Pop(2)
 			return nil, fmt.Errorf("pull array: expected numeric index, got '%s'", l.TypeOf(-2))
 		}
 
-		v, err := toGoValue(l, -1)
+		v, err := p.value(-1, fmt.Sprintf("%s[%d]", path, k))
 		if err != nil {
 			l.Pop(2)
 			return nil, err
@@ -133,24 +261,66 @@ func pullArrayRec(l *lua.State, idx int) (interface{}, error) {
 	return table, nil
 }
 
-func toGoValue(l *lua.State, idx int) (interface{}, error) {
+func (p *puller) value(idx int, path string) (interface{}, error) {
+	l := p.l
+	p.size++
+	if p.opts.MaxSize > 0 && p.size > p.opts.MaxSize {
+		return nil, fmt.Errorf("pull table, maximum size of %d values exceeded at %s", p.opts.MaxSize, path)
+	}
 	t := l.TypeOf(idx)
 	switch t {
+	case lua.TypeNil:
+		return nil, nil
 	case lua.TypeBoolean:
 		return l.ToBoolean(idx), nil
 	case lua.TypeString:
-		return lua.CheckString(l, idx), nil
+		s, _ := l.ToString(idx)
+		if p.opts.Bytes && !utf8.ValidString(s) {
+			return []byte(s), nil
+		}
+		return s, nil
 	case lua.TypeNumber:
-		return lua.CheckInteger(l, idx), nil
+		return goNumber(lua.CheckNumber(l, idx), p.opts.Numbers), nil
 	case lua.TypeTable:
-		return pullTableRec(l, idx)
+		return p.table(idx, path)
+	case lua.TypeUserData:
+		if IsNull(l, idx) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("pull table, unsupported type %s at %s", lua.TypeNameOf(l, idx), path)
 	default:
-		err := fmt.Errorf("pull table, unsupported type %s", lua.TypeNameOf(l, idx))
+		err := fmt.Errorf("pull table, unsupported type %s at %s", lua.TypeNameOf(l, idx), path)
 		return nil, err
 	}
 }
 
+const (
+	maxInt = int(^uint(0) >> 1)
+	minInt = -maxInt - 1
+)
+
+// goNumber converts a Lua number, integral values within the int range becoming int in NumberAuto mode
+func goNumber(f float64, mode NumberMode) interface{} {
+	if mode == NumberAuto && f == math.Trunc(f) && f >= float64(minInt) && f < float64(maxInt) {
+		return int(f)
+	}
+	return f
+}
+
+// PullBytes returns the raw bytes of the string at idx, which may hold binary data
+func PullBytes(l *lua.State, idx int) ([]byte, error) {
+	if l.TypeOf(idx) != lua.TypeString {
+		return nil, fmt.Errorf("need a string at index %d, got %s", idx, lua.TypeNameOf(l, idx))
+	}
+	s, _ := l.ToString(idx)
+	return []byte(s), nil
+}
+
 func PullVarargs(l *lua.State, startIndex int) ([]interface{}, error) {
+	return pullVarargsWith(l, startIndex, environmentPullOptions(l))
+}
+
+func pullVarargsWith(l *lua.State, startIndex int, opts PullOptions) ([]interface{}, error) {
 	top := l.Top()
 	if top < startIndex {
 		return []interface{}{}, nil
@@ -170,16 +340,30 @@ func PullVarargs(l *lua.State, startIndex int) ([]interface{}, error) {
 		case lua.TypeNumber:
 			value = lua.CheckNumber(l, i)
 		case lua.TypeString:
-			value = lua.CheckString(l, i)
+			s, _ := l.ToString(i)
+			if opts.Bytes && !utf8.ValidString(s) {
+				value = []byte(s)
+			} else {
+				value = s
+			}
 		case lua.TypeTable:
-			value, err = PullTable(l, i)
+			value, err = PullTableWith(l, i, opts)
 			if err != nil {
 				return nil, err
 			}
 		case lua.TypeFunction:
-			value = l.ToGoFunction(i)
+			if l.IsGoFunction(i) {
+				value = l.ToGoFunction(i)
+			} else if opts.Functions {
+				value, err = NewLuaFunction(l, i)
+				if err != nil {
+					return nil, err
+				}
+			}
 		case lua.TypeUserData:
-			value = l.ToUserData(i)
+			if !IsNull(l, i) {
+				value = l.ToUserData(i)
+			}
 		case lua.TypeThread:
 			value = l.ToThread(i)
 		}
@@ -198,15 +382,103 @@ func MustPullVarargs(l *lua.State, startIndex int) []interface{} {
 }
 
 func DeepPush(l *lua.State, v interface{}) int {
-	forwardOnType(l, v)
+	return DeepPushWith(l, v, PushOptions{})
+}
+
+// PushOptions tunes the conversion of Go values to Lua values
+type PushOptions struct {
+	// Nulls pushes nil values as luabox.null, keeping them in tables
+	Nulls bool
+	// MaxDepth bounds the nesting of values, DefaultMaxDepth when 0
+	MaxDepth int
+	// MaxSize bounds the total number of converted values, unlimited when 0
+	MaxSize int
+}
+
+func DeepPushWith(l *lua.State, v interface{}, opts PushOptions) int {
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = DefaultMaxDepth
+	}
+	p := &pusher{l: l, opts: opts, ancestors: make(map[visit]int)}
+	p.value(v)
 	return 1
 }
 
-func forwardOnType(l *lua.State, val interface{}) {
+// visit identifies a Go map, slice or pointer being pushed
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// pathSegment locates a value in its parent: a member name, a map key, a 1-based index or the key of a table entry
+type pathSegment struct {
+	name  string
+	key   interface{}
+	index int
+	isKey bool
+}
+
+type pusher struct {
+	l    *lua.State
+	opts PushOptions
+	// segments of the path of the value being pushed, only formatted for errors
+	segments []pathSegment
+	depth    int
+	size     int
+	// ancestors are the containers being pushed, with the length of their path
+	ancestors map[visit]int
+}
+
+// path formats the path of the value being pushed, or of one of its ancestors with n segments
+func (p *pusher) path(n int) string {
+	b := strings.Builder{}
+	b.WriteString("$")
+	for _, s := range p.segments[:n] {
+		switch {
+		case s.isKey:
+			b.WriteString("[key]")
+		case s.index > 0:
+			fmt.Fprintf(&b, "[%d]", s.index)
+		case s.key != nil:
+			fmt.Fprintf(&b, ".%v", s.key)
+		default:
+			b.WriteString("." + s.name)
+		}
+	}
+	return b.String()
+}
+
+func (p *pusher) fail(format string, args ...interface{}) {
+	lua.Errorf(p.l, "%s", fmt.Sprintf(format, args...)+" at "+p.path(len(p.segments)))
+	panic("unreachable")
+}
+
+// push pushes a value found at seg in the value being pushed
+func (p *pusher) push(val interface{}, seg pathSegment) {
+	p.segments = append(p.segments, seg)
+	p.value(val)
+	p.segments = p.segments[:len(p.segments)-1]
+}
+
+func (p *pusher) value(val interface{}) {
+	p.size++
+	if p.opts.MaxSize > 0 && p.size > p.opts.MaxSize {
+		p.fail("maximum size of %d values exceeded", p.opts.MaxSize)
+	}
+	p.forwardOnType(val)
+}
+
+func (p *pusher) forwardOnType(val interface{}) {
+	l := p.l
 
 	switch val := val.(type) {
 	case nil:
-		l.PushNil()
+		if p.opts.Nulls {
+			PushNull(l)
+		} else {
+			l.PushNil()
+		}
 
 	case bool:
 		l.PushBoolean(val)
@@ -242,29 +514,104 @@ func forwardOnType(l *lua.State, val interface{}) {
 		l.PushNumber(val)
 
 	case complex64:
-		forwardOnType(l, []float32{real(val), imag(val)})
+		p.forwardOnType([]float32{real(val), imag(val)})
 	case complex128:
-		forwardOnType(l, []float64{real(val), imag(val)})
+		p.forwardOnType([]float64{real(val), imag(val)})
+
+	case []byte:
+		l.PushString(string(val))
+	case time.Time:
+		l.PushString(val.Format(time.RFC3339Nano))
+	case OrderedMap:
+		p.pushOrdered(val)
 
 	default:
-		forwardOnReflect(l, val)
+		if ot, ok := registeredType(l, reflect.TypeOf(val)); ok {
+			l.PushUserData(val)
+			lua.SetMetaTableNamed(l, ot.name)
+			return
+		}
+		p.forwardOnReflect(val)
 	}
 }
 
-func forwardOnReflect(l *lua.State, val interface{}) {
+// enter guards against cyclic and too deeply nested values, the returned function must be called once the value is pushed
+func (p *pusher) enter(v reflect.Value) func() {
+	if p.depth >= p.opts.MaxDepth {
+		p.fail("maximum depth of %d exceeded", p.opts.MaxDepth)
+	}
+	if !p.l.CheckStack(3) {
+		p.fail("stack exhausted")
+	}
+	p.depth++
+	switch v.Kind() {
+	case reflect.Map, reflect.Ptr, reflect.Slice:
+		key := visit{ptr: v.Pointer(), typ: v.Type()}
+		if v.Kind() == reflect.Slice {
+			key.len = v.Len()
+		}
+		if key.ptr == 0 {
+			break
+		}
+		if ancestor, ok := p.ancestors[key]; ok {
+			lua.Errorf(p.l, "%s", fmt.Sprintf("cycle at %s referencing %s", p.path(len(p.segments)), p.path(ancestor)))
+			panic("unreachable")
+		}
+		p.ancestors[key] = len(p.segments)
+		return func() {
+			delete(p.ancestors, key)
+			p.depth--
+		}
+	}
+	return func() { p.depth-- }
+}
+
+func (p *pusher) forwardOnReflect(val interface{}) {
+	l := p.l
 
 	switch v := reflect.ValueOf(val); v.Kind() {
 
+	case reflect.Bool:
+		l.PushBoolean(v.Bool())
+	case reflect.String:
+		l.PushString(v.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		l.PushNumber(float64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		l.PushNumber(float64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		l.PushNumber(v.Float())
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			l.PushNil()
+		} else {
+			defer p.enter(v)()
+			p.forwardOnType(v.Elem().Interface())
+		}
+
+	case reflect.Struct:
+		defer p.enter(v)()
+		p.pushStruct(v)
+
+	case reflect.Func:
+		pushFunc(l, v)
+
+	case reflect.Chan:
+		pushChannel(l, v)
+
 	case reflect.Array, reflect.Slice:
-		recurseOnFuncSlice(l, func(i int) interface{} { return v.Index(i).Interface() }, v.Len())
+		defer p.enter(v)()
+		p.recurseOnFuncSlice(func(i int) interface{} { return v.Index(i).Interface() }, v.Len())
 
 	case reflect.Map:
+		defer p.enter(v)()
 		l.CreateTable(0, v.Len())
 		for _, key := range v.MapKeys() {
 			mapKey := key.Interface()
 			mapVal := v.MapIndex(key).Interface()
-			forwardOnType(l, mapKey)
-			forwardOnType(l, mapVal)
+			p.push(mapKey, pathSegment{isKey: true})
+			p.push(mapVal, pathSegment{key: mapKey})
 			l.RawSet(-3)
 		}
 
@@ -277,10 +624,15 @@ func forwardOnReflect(l *lua.State, val interface{}) {
 
 // the hack of using a func(int)interface{} makes it that it is valid for any
 // type of slice
-func recurseOnFuncSlice(l *lua.State, input func(int) interface{}, n int) {
+func (p *pusher) recurseOnFuncSlice(input func(int) interface{}, n int) {
+	l := p.l
 	l.CreateTable(n, 0)
+	if n == 0 {
+		// keep empty arrays distinct from empty objects
+		setTableType(l, -1, TableArray)
+	}
 	for i := 0; i < n; i++ {
-		forwardOnType(l, input(i))
+		p.push(input(i), pathSegment{index: i + 1})
 		l.RawSetInt(-2, i+1)
 	}
 }
@@ -0,0 +1,434 @@
+/*
+ *    Copyright 2020 Josselin Pujo
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package luabox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/Shopify/go-lua"
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// YamlDocument is a YAML document kept as a node tree, so that editing it preserves comments, anchors and styles.
+// Paths are either strings like "servers[2].port" or arrays of keys and 1-based indexes.
+type YamlDocument struct {
+	root   *yaml.Node
+	indent int
+}
+
+// ParseYamlDocument parses a YAML document, keeping its indentation for re-encoding
+func ParseYamlDocument(s string) (*YamlDocument, error) {
+	d := &YamlDocument{root: &yaml.Node{}, indent: detectIndent(s)}
+	if err := yaml.Unmarshal([]byte(s), d.root); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// detectIndent returns the smallest indentation of the document, 2 when nothing is indented
+func detectIndent(s string) int {
+	indent := 0
+	for _, line := range strings.Split(s, "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		n := len(line) - len(trimmed)
+		if n == 0 || trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if indent == 0 || n < indent {
+			indent = n
+		}
+	}
+	if indent == 0 {
+		return 2
+	}
+	return indent
+}
+
+// Encode re-encodes the document, with the given indentation or the original one when 0
+func (d *YamlDocument) Encode(indent int) (string, error) {
+	if d.root.Kind == 0 {
+		return "", nil
+	}
+	if indent <= 0 {
+		indent = d.indent
+	}
+	b := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(b)
+	encoder.SetIndent(indent)
+	if err := encoder.Encode(d.root); err != nil {
+		return "", err
+	}
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func (d *YamlDocument) String() string {
+	s, err := d.Encode(0)
+	if err != nil {
+		return err.Error()
+	}
+	return s
+}
+
+// ParsePath splits a path like "$.servers[2].port" or "a['key.with.dots']" into keys and 1-based indexes
+func ParsePath(path string) ([]interface{}, error) {
+	segments := make([]interface{}, 0)
+	s := strings.TrimPrefix(path, "$")
+	for s != "" {
+		switch s[0] {
+		case '.':
+			s = s[1:]
+			fallthrough
+		default:
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid path %q: empty key", path)
+			}
+			segments = append(segments, s[:end])
+			s = s[end:]
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q: unclosed [", path)
+			}
+			inner := s[1:end]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				segments = append(segments, inner[1:len(inner)-1])
+			} else if i, err := strconv.Atoi(inner); err == nil && i > 0 {
+				segments = append(segments, i)
+			} else {
+				return nil, fmt.Errorf("invalid path %q: bad index [%s]", path, inner)
+			}
+			s = s[end+1:]
+		}
+	}
+	return segments, nil
+}
+
+func mappingIndex(n *yaml.Node, key string) int {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+func resolveAlias(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	return n
+}
+
+func (d *YamlDocument) top() *yaml.Node {
+	if d.root.Kind == 0 {
+		d.root.Kind = yaml.DocumentNode
+	}
+	if len(d.root.Content) == 0 {
+		d.root.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	return d.root.Content[0]
+}
+
+// child returns the node of a segment, with its parent and position, or nil
+func child(parent *yaml.Node, segment interface{}) (*yaml.Node, int) {
+	parent = resolveAlias(parent)
+	switch s := segment.(type) {
+	case string:
+		if parent.Kind == yaml.MappingNode {
+			if i := mappingIndex(parent, s); i >= 0 {
+				return parent.Content[i], i
+			}
+		}
+	case int:
+		if parent.Kind == yaml.SequenceNode && s >= 1 && s <= len(parent.Content) {
+			return parent.Content[s-1], s - 1
+		}
+	}
+	return nil, -1
+}
+
+// Lookup returns the node at path, aliases being resolved
+func (d *YamlDocument) Lookup(path []interface{}) (*yaml.Node, bool) {
+	if d.root.Kind == 0 {
+		return nil, false
+	}
+	n := d.top()
+	for _, segment := range path {
+		n, _ = child(n, segment)
+		if n == nil {
+			return nil, false
+		}
+	}
+	return resolveAlias(n), true
+}
+
+// Get returns the value at path, mappings as OrderedMap
+func (d *YamlDocument) Get(path []interface{}) (interface{}, bool, error) {
+	n, ok := d.Lookup(path)
+	if !ok {
+		return nil, false, nil
+	}
+	v, err := orderedYAML(n)
+	return v, true, err
+}
+
+// Set replaces the value at path, creating missing mapping keys.
+// The comments, anchor and quoting style of a replaced node are kept.
+func (d *YamlDocument) Set(path []interface{}, value interface{}) error {
+	node, err := yamlNode(yamlBinary(value))
+	if err != nil {
+		return err
+	}
+	if len(path) == 0 {
+		replaceNode(d.top(), node)
+		return nil
+	}
+	parent := d.top()
+	for i, segment := range path[:len(path)-1] {
+		next, _ := child(parent, segment)
+		if next == nil {
+			key, ok := segment.(string)
+			parent = resolveAlias(parent)
+			if !ok || parent.Kind != yaml.MappingNode {
+				return fmt.Errorf("cannot create %s", formatPath(path[:i+1]))
+			}
+			next = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, next)
+		}
+		parent = next
+	}
+	last := path[len(path)-1]
+	if existing, _ := child(parent, last); existing != nil {
+		replaceNode(existing, node)
+		return nil
+	}
+	parent = resolveAlias(parent)
+	switch key := last.(type) {
+	case string:
+		if parent.Kind == yaml.MappingNode {
+			parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, node)
+			return nil
+		}
+	case int:
+		if parent.Kind == yaml.SequenceNode && key == len(parent.Content)+1 {
+			parent.Content = append(parent.Content, node)
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot set %s", formatPath(path))
+}
+
+func replaceNode(old, node *yaml.Node) {
+	if old.Kind == yaml.ScalarNode && node.Kind == yaml.ScalarNode && node.Tag == "!!str" {
+		node.Style = old.Style
+	}
+	if old.Kind == node.Kind && node.Kind != yaml.ScalarNode {
+		node.Style = old.Style
+	}
+	node.Anchor = old.Anchor
+	node.HeadComment = old.HeadComment
+	node.LineComment = old.LineComment
+	node.FootComment = old.FootComment
+	*old = *node
+}
+
+// Insert inserts a value in the sequence at path, before the 1-based position pos, or at its end when pos is 0
+func (d *YamlDocument) Insert(path []interface{}, value interface{}, pos int) error {
+	seq, ok := d.Lookup(path)
+	if !ok || seq.Kind != yaml.SequenceNode {
+		return fmt.Errorf("no sequence at %s", formatPath(path))
+	}
+	if pos == 0 {
+		pos = len(seq.Content) + 1
+	}
+	if pos < 1 || pos > len(seq.Content)+1 {
+		return fmt.Errorf("position %d out of the sequence at %s", pos, formatPath(path))
+	}
+	node, err := yamlNode(yamlBinary(value))
+	if err != nil {
+		return err
+	}
+	seq.Content = append(seq.Content, nil)
+	copy(seq.Content[pos:], seq.Content[pos-1:])
+	seq.Content[pos-1] = node
+	return nil
+}
+
+// Remove removes the mapping key or sequence item at path, returning false when it does not exist
+func (d *YamlDocument) Remove(path []interface{}) (bool, error) {
+	if len(path) == 0 {
+		return false, errors.New("cannot remove the document root")
+	}
+	parent, ok := d.Lookup(path[:len(path)-1])
+	if !ok {
+		return false, nil
+	}
+	n, i := child(parent, path[len(path)-1])
+	if n == nil {
+		return false, nil
+	}
+	if parent.Kind == yaml.MappingNode {
+		parent.Content = append(parent.Content[:i-1], parent.Content[i+1:]...)
+	} else {
+		parent.Content = append(parent.Content[:i], parent.Content[i+1:]...)
+	}
+	return true, nil
+}
+
+func formatPath(path []interface{}) string {
+	b := strings.Builder{}
+	b.WriteString("$")
+	for _, segment := range path {
+		if i, ok := segment.(int); ok {
+			b.WriteString("[" + strconv.Itoa(i) + "]")
+		} else {
+			b.WriteString(fmt.Sprintf(".%v", segment))
+		}
+	}
+	return b.String()
+}
+
+func checkYamlDocument(l *lua.State) *YamlDocument {
+	var d *YamlDocument
+	CheckObject(l, 1, &d)
+	return d
+}
+
+// checkPath reads a path argument, either a string or an array of keys and indexes
+func checkPath(l *lua.State, idx int) []interface{} {
+	if l.IsTable(idx) {
+		path := make([]interface{}, 0)
+		for i := 1; ; i++ {
+			l.RawGetInt(idx, i)
+			switch l.TypeOf(-1) {
+			case lua.TypeNil:
+				l.Pop(1)
+				return path
+			case lua.TypeNumber:
+				f, _ := l.ToNumber(-1)
+				path = append(path, int(f))
+			default:
+				s, _ := l.ToString(-1)
+				path = append(path, s)
+			}
+			l.Pop(1)
+		}
+	}
+	path, err := ParsePath(lua.OptString(l, idx, ""))
+	if err != nil {
+		lua.ArgumentError(l, idx, err.Error())
+		panic("unreachable")
+	}
+	return path
+}
+
+func checkValue(l *lua.State, idx int) interface{} {
+	v, err := newPuller(l, encoderPullOptions(l)).value(idx, "$")
+	if err != nil {
+		lua.Errorf(l, err.Error())
+		panic("unreachable")
+	}
+	return v
+}
+
+func yamlDocGet(l *lua.State) int {
+	v, ok, err := checkYamlDocument(l).Get(checkPath(l, 2))
+	if err != nil {
+		lua.Errorf(l, err.Error())
+		panic("unreachable")
+	}
+	if !ok {
+		l.PushNil()
+		return 1
+	}
+	return DeepPush(l, v)
+}
+
+func yamlDocSet(l *lua.State) int {
+	d := checkYamlDocument(l)
+	if err := d.Set(checkPath(l, 2), checkValue(l, 3)); err != nil {
+		lua.Errorf(l, err.Error())
+		panic("unreachable")
+	}
+	return 0
+}
+
+func yamlDocInsert(l *lua.State) int {
+	d := checkYamlDocument(l)
+	if err := d.Insert(checkPath(l, 2), checkValue(l, 3), lua.OptInteger(l, 4, 0)); err != nil {
+		lua.Errorf(l, err.Error())
+		panic("unreachable")
+	}
+	return 0
+}
+
+func yamlDocRemove(l *lua.State) int {
+	removed, err := checkYamlDocument(l).Remove(checkPath(l, 2))
+	if err != nil {
+		lua.Errorf(l, err.Error())
+		panic("unreachable")
+	}
+	l.PushBoolean(removed)
+	return 1
+}
+
+func yamlDocToString(l *lua.State) int {
+	s, err := checkYamlDocument(l).Encode(lua.OptInteger(l, 2, 0))
+	if err != nil {
+		lua.Errorf(l, err.Error())
+		panic("unreachable")
+	}
+	l.PushString(s)
+	return 1
+}
+
+// PushYamlDocument pushes a document as userdata with get, set, insert, remove and toString methods
+func PushYamlDocument(l *lua.State, d *YamlDocument) {
+	if _, ok := registeredType(l, reflect.TypeOf(d)); !ok {
+		RegisterType(l, d,
+			lua.RegistryFunction{Name: "get", Function: yamlDocGet},
+			lua.RegistryFunction{Name: "set", Function: yamlDocSet},
+			lua.RegistryFunction{Name: "insert", Function: yamlDocInsert},
+			lua.RegistryFunction{Name: "remove", Function: yamlDocRemove},
+			lua.RegistryFunction{Name: "toString", Function: yamlDocToString})
+	}
+	PushObject(l, d)
+}
+
+// ParseDocument parses a YAML string to a document object
+func ParseDocument(l *lua.State) int {
+	d, err := ParseYamlDocument(lua.CheckString(l, 1))
+	if err != nil {
+		l.PushString(err.Error())
+		l.Error()
+		return 0
+	}
+	PushYamlDocument(l, d)
+	return 1
+}